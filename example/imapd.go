@@ -3,6 +3,7 @@ package main
 import (
 	// "fmt"
 	"crypto/tls"
+	"crypto/x509"
 	"log"
 	"strings"
 	"time"
@@ -17,33 +18,45 @@ func (mb *TestMailbox) Info() (imapd.MailboxInfo, error) {
 	return imapd.MailboxInfo{
 		NextUid:     2,
 		UidValidity: 3,
-		Exists:      0,
+		Exists:      1,
 		Recent:      0,
 	}, nil
 }
 
+var testMessage = []byte(
+	"Date: Sat, 12 Jun 2012 08:09:48 -0400 (EDT)\r\n" +
+		"From: blah@blah.com\r\n" +
+		"To: test@examples.com\r\n" +
+		"Message-ID: <23913265.72143.7367657838142.JavaMail.cfusion@www4.example.com>\r\n" +
+		"Subject: Some email\r\n\r\n")
+
 // BODY.PEEK[HEADER.FIELDS (Date Subject From Sender Reply-To To Cc Message-ID References In-Reply-To)] INTERNALDATE
 
-func (mb *TestMailbox) FetchMessagesByUID(ranges []imapd.Range, items []imapd.MessageDataItemName) (map[uint32][]imapd.MessageDataItem, error) {
-	res := make(map[uint32][]imapd.MessageDataItem)
+// FetchMessages returns the test message as the only message with UID 1.
+func (mb *TestMailbox) FetchMessages(ranges []imapd.Range, items []imapd.MessageDataItemName, fn imapd.FetchFunc) error {
+	found := false
+	for _, r := range ranges {
+		found = found || r.Contains(1)
+	}
+	if !found {
+		return nil
+	}
 	data := make([]imapd.MessageDataItem, 0, len(items))
-	for i, it := range items {
+	for _, it := range items {
 		var d interface{} = nil
 		switch it.Name {
 		case "UID":
-			d = i + 1
+			d = 1
 		case "FLAGS":
 			d = []string{imapd.FlagSeen}
 		case "INTERNALDATE":
 			d = time.Now()
-		case "BODY.PEEK[]", "BODY[]":
-			it.Name = "BODY[]"
-			d = []byte(
-				"Date: Sat, 12 Jun 2012 08:09:48 -0400 (EDT)\r\n" +
-					"From: blah@blah.com\r\n" +
-					"To: test@examples.com\r\n" +
-					"Message-ID: <23913265.72143.7367657838142.JavaMail.cfusion@www4.example.com>\r\n" +
-					"Subject: Some email\r\n\r\n")
+		case "ENVELOPE":
+			d = imapd.ParseEnvelope(testMessage)
+		case "BODY", "BODYSTRUCTURE":
+			d = imapd.ParseBodyStructure(testMessage)
+		case "BODY.PEEK[]", "BODY[]", "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+			d = imapd.BodySection(testMessage, it)
 		}
 		if d != nil {
 			data = append(data, imapd.MessageDataItem{
@@ -52,15 +65,16 @@ func (mb *TestMailbox) FetchMessagesByUID(ranges []imapd.Range, items []imapd.Me
 			})
 		}
 	}
-	for _, r := range ranges {
-		res[r.Start] = data
-	}
-	return res, nil
+	return fn(1, data)
 }
 
 type TestBackend struct {
 }
 
+func (b *TestBackend) ListMailboxes() ([]*imapd.MailboxResponse, error) {
+	return []*imapd.MailboxResponse{{Name: "INBOX", Delimiter: "/"}}, nil
+}
+
 func (b *TestBackend) Mailbox(name string) (imapd.Mailbox, error) {
 	if strings.ToLower(name) == "inbox" {
 		return &TestMailbox{}, nil
@@ -68,6 +82,29 @@ func (b *TestBackend) Mailbox(name string) (imapd.Mailbox, error) {
 	return nil, imapd.ErrUnknownMailbox
 }
 
+func (b *TestBackend) Login(username, password string) (imapd.Backend, error) {
+	if username == "test" && password == "test" {
+		return b, nil
+	}
+	return nil, imapd.ErrAuthenticationFailed
+}
+
+func (b *TestBackend) LookupUser(username string) (imapd.Backend, error) {
+	if username == "test" {
+		return b, nil
+	}
+	return nil, imapd.ErrAuthenticationFailed
+}
+
+// mapCertificate allows a client certificate issued to "test" to log in
+// using the EXTERNAL mechanism.
+func mapCertificate(cert *x509.Certificate, authzid string) (string, error) {
+	if cert.Subject.CommonName != "test" || (authzid != "" && authzid != "test") {
+		return "", imapd.ErrAuthenticationFailed
+	}
+	return "test", nil
+}
+
 func main() {
 	cert, err := tls.LoadX509KeyPair("cert.pem", "key.pem")
 	if err != nil {
@@ -75,9 +112,10 @@ func main() {
 	}
 
 	im := &imapd.Server{
-		Addr:          ":1143",
-		InsecureLogin: true,
-		Backend:       &TestBackend{},
+		Addr:           ":1143",
+		InsecureLogin:  true,
+		Backend:        &TestBackend{},
+		MapCertificate: mapCertificate,
 		TlsConfig: &tls.Config{
 			Certificates: []tls.Certificate{cert},
 			ClientAuth:   tls.VerifyClientCertIfGiven,
@@ -0,0 +1,311 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"mime"
+	"net/textproto"
+	"sort"
+	"strings"
+)
+
+// BodyStructure is the MIME structure of a message or body part as
+// returned for BODY and BODYSTRUCTURE.
+type BodyStructure struct {
+	Type        string // e.g. TEXT, MULTIPART
+	Subtype     string // e.g. PLAIN, MIXED
+	Params      map[string]string
+	ID          string
+	Description string
+	Encoding    string // e.g. 7BIT, BASE64
+	Size        uint32 // octets of the encoded body
+	Lines       uint32 // TEXT and MESSAGE/RFC822 only
+
+	Envelope *Envelope        // MESSAGE/RFC822 only
+	Body     *BodyStructure   // MESSAGE/RFC822 only
+	Parts    []*BodyStructure // MULTIPART only
+
+	// Extension data only returned by BODYSTRUCTURE
+	MD5               string
+	Disposition       string
+	DispositionParams map[string]string
+	Language          []string
+	Location          string
+}
+
+// ParseBodyStructure returns the MIME structure of a raw RFC 5322 message.
+func ParseBodyStructure(message []byte) *BodyStructure {
+	return parseMIMEPart(message, false, 0).bodyStructure()
+}
+
+// mimePart is a parsed message or body part.
+type mimePart struct {
+	rawHeader []byte
+	header    textproto.MIMEHeader
+	body      []byte
+	mediaType string // lower case type/subtype
+	params    map[string]string
+	parts     []*mimePart // multipart
+	message   *mimePart   // message/rfc822
+}
+
+// maxMIMEDepth is the maximum nesting of body parts. Deeper multipart and
+// message/rfc822 parts aren't parsed.
+const maxMIMEDepth = 100
+
+// parseMIMEPart parses a body part at the nesting depth. Parts of a
+// multipart/digest default to message/rfc822 rather than text/plain.
+func parseMIMEPart(raw []byte, digest bool, depth int) *mimePart {
+	p := &mimePart{}
+	p.rawHeader, p.body = splitHeader(raw)
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(p.rawHeader)))
+	p.header, _ = r.ReadMIMEHeader()
+	if p.header == nil {
+		p.header = textproto.MIMEHeader{}
+	}
+	contentType := p.header.Get("Content-Type")
+	var err error
+	p.mediaType, p.params, err = mime.ParseMediaType(contentType)
+	if err == mime.ErrInvalidMediaParameter {
+		// Keep the type and the valid parameters, notably the boundary,
+		// rather than flattening the part because of a stray parameter.
+		p.params, err = validMediaParams(contentType), nil
+	}
+	if err != nil || !strings.Contains(p.mediaType, "/") {
+		p.mediaType, p.params = "text/plain", map[string]string{"charset": "us-ascii"}
+		if digest {
+			p.mediaType, p.params = "message/rfc822", nil
+		}
+	}
+	isContainer := strings.HasPrefix(p.mediaType, "multipart/") || p.mediaType == "message/rfc822"
+	if isContainer && depth >= maxMIMEDepth {
+		// Parts nested too deeply are left opaque.
+		p.mediaType, p.params = "application/octet-stream", nil
+	}
+	if strings.HasPrefix(p.mediaType, "multipart/") {
+		for _, raw := range splitMultipart(p.body, p.params["boundary"]) {
+			p.parts = append(p.parts, parseMIMEPart(raw, p.mediaType == "multipart/digest", depth+1))
+		}
+		if len(p.parts) == 0 {
+			// A multipart without parts can't be represented.
+			p.mediaType, p.params = "text/plain", map[string]string{"charset": "us-ascii"}
+		}
+	} else if p.mediaType == "message/rfc822" {
+		p.message = parseMIMEPart(p.body, false, depth+1)
+	}
+	return p
+}
+
+// validMediaParams returns the parameters of a Content-Type header value
+// that can be parsed on their own.
+func validMediaParams(v string) map[string]string {
+	params := map[string]string{}
+	segments := strings.Split(v, ";")
+	for _, seg := range segments[1:] {
+		if _, ps, err := mime.ParseMediaType("x/x;" + seg); err == nil {
+			for k, val := range ps {
+				params[k] = val
+			}
+		}
+	}
+	return params
+}
+
+// splitHeader splits a message or body part at the empty line ending the
+// header. The header includes the empty line.
+func splitHeader(raw []byte) (header, body []byte) {
+	for i := 0; i < len(raw); {
+		end := len(raw)
+		if n := bytes.IndexByte(raw[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+		if len(bytes.TrimRight(raw[i:end], "\r\n")) == 0 {
+			return raw[:end], raw[end:]
+		}
+		i = end
+	}
+	return raw, nil
+}
+
+// splitMultipart returns the body parts between the boundary delimiters.
+// The line break before a delimiter belongs to the delimiter.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+	var parts [][]byte
+	start := -1
+	for i := 0; i < len(body); {
+		end := len(body)
+		if n := bytes.IndexByte(body[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+		if line := body[i:end]; bytes.HasPrefix(line, delim) {
+			rest := bytes.TrimRight(line[len(delim):], " \t\r\n")
+			if len(rest) == 0 || string(rest) == "--" {
+				if start >= 0 {
+					parts = append(parts, trimLineBreak(body[start:i]))
+				}
+				if len(rest) != 0 {
+					return parts
+				}
+				start = end
+			}
+		}
+		i = end
+	}
+	if start >= 0 && start < len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+func trimLineBreak(b []byte) []byte {
+	if bytes.HasSuffix(b, []byte("\r\n")) {
+		return b[:len(b)-2]
+	}
+	return bytes.TrimSuffix(b, []byte("\n"))
+}
+
+func countLines(b []byte) uint32 {
+	n := bytes.Count(b, []byte("\n"))
+	if len(b) > 0 && b[len(b)-1] != '\n' {
+		n++
+	}
+	return uint32(n)
+}
+
+func (p *mimePart) bodyStructure() *BodyStructure {
+	typ := strings.SplitN(p.mediaType, "/", 2)
+	bs := &BodyStructure{
+		Type:        strings.ToUpper(typ[0]),
+		Subtype:     strings.ToUpper(typ[1]),
+		Params:      p.params,
+		ID:          p.header.Get("Content-Id"),
+		Description: p.header.Get("Content-Description"),
+		Encoding:    strings.ToUpper(p.header.Get("Content-Transfer-Encoding")),
+		Size:        uint32(len(p.body)),
+		MD5:         p.header.Get("Content-Md5"),
+		Location:    p.header.Get("Content-Location"),
+	}
+	if bs.Encoding == "" {
+		bs.Encoding = "7BIT"
+	}
+	if d := p.header.Get("Content-Disposition"); d != "" {
+		if disp, params, err := mime.ParseMediaType(d); err == nil {
+			bs.Disposition = strings.ToUpper(disp)
+			bs.DispositionParams = params
+		}
+	}
+	for _, lang := range strings.Split(p.header.Get("Content-Language"), ",") {
+		if lang = strings.TrimSpace(lang); lang != "" {
+			bs.Language = append(bs.Language, lang)
+		}
+	}
+	if p.parts != nil {
+		for _, part := range p.parts {
+			bs.Parts = append(bs.Parts, part.bodyStructure())
+		}
+	}
+	if p.message != nil {
+		bs.Envelope = envelopeFromHeader(p.message.header)
+		bs.Body = p.message.bodyStructure()
+	}
+	if bs.Type == "TEXT" || p.message != nil {
+		bs.Lines = countLines(p.body)
+	}
+	return bs
+}
+
+func (bs *BodyStructure) appendValue(b []byte) []byte {
+	return bs.value(true).appendValue(b)
+}
+
+// String returns the BODYSTRUCTURE parenthesized list.
+func (bs *BodyStructure) String() string {
+	return encodeValue(bs)
+}
+
+// Format returns the BODYSTRUCTURE parenthesized list if extended is true,
+// otherwise the BODY list without extension data.
+func (bs *BodyStructure) Format(extended bool) string {
+	return encodeValue(bs.value(extended))
+}
+
+func (bs *BodyStructure) value(extended bool) Value {
+	var out List
+	if bs.Type == "MULTIPART" {
+		parts := make(bodyParts, len(bs.Parts))
+		for i, part := range bs.Parts {
+			parts[i] = part.value(extended)
+		}
+		out = List{parts, Quoted(bs.Subtype)}
+		if extended {
+			out = append(out, paramList(bs.Params))
+		}
+	} else {
+		out = List{
+			Quoted(bs.Type),
+			Quoted(bs.Subtype),
+			paramList(bs.Params),
+			NString(bs.ID),
+			NString(bs.Description),
+			Quoted(bs.Encoding),
+			Number64(bs.Size),
+		}
+		if bs.Envelope != nil && bs.Body != nil {
+			out = append(out, bs.Envelope, bs.Body.value(extended))
+		}
+		if bs.Type == "TEXT" || bs.Body != nil {
+			out = append(out, Number64(bs.Lines))
+		}
+		if extended {
+			out = append(out, NString(bs.MD5))
+		}
+	}
+	if extended {
+		var disposition Value = NString("")
+		if bs.Disposition != "" {
+			disposition = List{Quoted(bs.Disposition), paramList(bs.DispositionParams)}
+		}
+		var language Value = NString("")
+		if len(bs.Language) == 1 {
+			language = Quoted(bs.Language[0])
+		} else if len(bs.Language) > 1 {
+			langs := make(List, len(bs.Language))
+			for i, lang := range bs.Language {
+				langs[i] = Quoted(lang)
+			}
+			language = langs
+		}
+		out = append(out, disposition, language, NString(bs.Location))
+	}
+	return out
+}
+
+// bodyParts are the parts of a multipart body which unlike a List are
+// not parenthesized or separated by spaces.
+type bodyParts []Value
+
+func (p bodyParts) appendValue(b []byte) []byte {
+	for _, v := range p {
+		b = v.appendValue(b)
+	}
+	return b
+}
+
+// paramList returns the body parameters as a list of upper case names and
+// values sorted by name, or NIL.
+func paramList(params map[string]string) Value {
+	if len(params) == 0 {
+		return NString("")
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := make(List, 0, 2*len(names))
+	for _, name := range names {
+		out = append(out, Quoted(strings.ToUpper(name)), Quoted(params[name]))
+	}
+	return out
+}
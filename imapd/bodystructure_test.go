@@ -0,0 +1,98 @@
+package imapd
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+var testMIMEMessage = "From: joe@example.com\r\n" +
+	"Subject: Report\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/mixed; boundary=\"outer\"\r\n" +
+	"\r\n" +
+	"Preamble\r\n" +
+	"--outer\r\n" +
+	"Content-Type: multipart/alternative; boundary=inner\r\n" +
+	"\r\n" +
+	"--inner\r\n" +
+	"\r\n" +
+	"Plain text\r\n" +
+	"--inner\r\n" +
+	"Content-Type: text/html; charset=UTF-8\r\n" +
+	"Content-Transfer-Encoding: quoted-printable\r\n" +
+	"Content-Language: en, de\r\n" +
+	"\r\n" +
+	"<p>Html</p>\r\n" +
+	"\r\n" +
+	"--inner--\r\n" +
+	"--outer\r\n" +
+	"Content-Type: application/pdf; name=\"report.pdf\"\r\n" +
+	"Content-Transfer-Encoding: base64\r\n" +
+	"Content-Disposition: attachment; filename=\"report.pdf\"\r\n" +
+	"Content-ID: <part3@example.com>\r\n" +
+	"\r\n" +
+	"JVBERi0xLjQK\r\n" +
+	"--outer\r\n" +
+	"Content-Type: message/rfc822\r\n" +
+	"\r\n" +
+	"From: ann@example.com\r\n" +
+	"Subject: Forwarded\r\n" +
+	"\r\n" +
+	"Hello\r\n" +
+	"--outer--\r\n" +
+	"Epilogue\r\n"
+
+func TestParseBodyStructure(t *testing.T) {
+	bs := ParseBodyStructure([]byte(testMIMEMessage))
+	exp := `((("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 10 1)` +
+		`("TEXT" "HTML" ("CHARSET" "UTF-8") NIL NIL "QUOTED-PRINTABLE" 13 1) "ALTERNATIVE")` +
+		`("APPLICATION" "PDF" ("NAME" "report.pdf") "<part3@example.com>" NIL "BASE64" 12)` +
+		`("MESSAGE" "RFC822" NIL NIL NIL "7BIT" 50 ` +
+		`(NIL "Forwarded" ((NIL NIL "ann" "example.com")) ((NIL NIL "ann" "example.com")) ((NIL NIL "ann" "example.com")) NIL NIL NIL NIL NIL) ` +
+		`("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 5 1) 4) "MIXED")`
+	if s := bs.Format(false); s != exp {
+		t.Fatalf("BODY returned\n%s\nexpected\n%s", s, exp)
+	}
+
+	exp = `((("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 10 1 NIL NIL NIL NIL)` +
+		`("TEXT" "HTML" ("CHARSET" "UTF-8") NIL NIL "QUOTED-PRINTABLE" 13 1 NIL NIL ("en" "de") NIL) "ALTERNATIVE" ("BOUNDARY" "inner") NIL NIL NIL)` +
+		`("APPLICATION" "PDF" ("NAME" "report.pdf") "<part3@example.com>" NIL "BASE64" 12 NIL ("ATTACHMENT" ("FILENAME" "report.pdf")) NIL NIL)`
+	if s := bs.String(); len(s) < len(exp) || s[:len(exp)] != exp {
+		t.Fatalf("BODYSTRUCTURE returned\n%s\nexpected prefix\n%s", s, exp)
+	}
+
+	exp = `("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 8 2)`
+	if s := ParseBodyStructure([]byte("Subject: Plain\r\n\r\nLine 1\nX")).Format(false); s != exp {
+		t.Fatalf("BODY returned %s expected %s", s, exp)
+	}
+}
+
+func TestParseBodyStructureInvalidParam(t *testing.T) {
+	msg := "Content-Type: multipart/mixed; boundary=\"x\"; foo\r\n\r\n" +
+		"--x\r\nContent-Type: text/plain; charset=utf-8; bar=\r\n\r\nOne\r\n" +
+		"--x\r\n\r\nTwo\r\n--x--\r\n"
+	exp := `(("TEXT" "PLAIN" ("CHARSET" "utf-8") NIL NIL "7BIT" 3 1)` +
+		`("TEXT" "PLAIN" ("CHARSET" "us-ascii") NIL NIL "7BIT" 3 1) "MIXED")`
+	if s := ParseBodyStructure([]byte(msg)).Format(false); s != exp {
+		t.Fatalf("BODY returned\n%s\nexpected\n%s", s, exp)
+	}
+}
+
+func TestParseBodyStructureDepth(t *testing.T) {
+	var b strings.Builder
+	b.WriteString("Subject: Nested\r\n")
+	for i := 0; i < 2*maxMIMEDepth; i++ {
+		fmt.Fprintf(&b, "Content-Type: multipart/mixed; boundary=b%d\r\n\r\n--b%d\r\n", i, i)
+	}
+	b.WriteString("\r\nText\r\n")
+	bs := ParseBodyStructure([]byte(b.String()))
+	depth := 0
+	for len(bs.Parts) == 1 {
+		bs = bs.Parts[0]
+		depth++
+	}
+	if depth != maxMIMEDepth || bs.Type != "APPLICATION" || bs.Subtype != "OCTET-STREAM" {
+		t.Fatalf("ParseBodyStructure returned %s/%s at depth %d", bs.Type, bs.Subtype, depth)
+	}
+}
@@ -0,0 +1,1406 @@
+package imapd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"sort"
+	"strings"
+	"time"
+)
+
+// 3. State and Flow Diagram
+type sessionState int
+
+const (
+	stateNotAuthenticated sessionState = 1 << iota
+	stateAuthenticated
+	stateSelected
+	stateLogout
+
+	stateAny            = stateNotAuthenticated | stateAuthenticated | stateSelected
+	stateAuthOrSelected = stateAuthenticated | stateSelected
+)
+
+type command struct {
+	states  sessionState // states in which the command is valid
+	handler func(s *session, tag string, args []arg)
+}
+
+var (
+	commands    map[string]*command
+	uidCommands map[string]*command
+)
+
+// holdExpunge are the commands during which EXPUNGE responses can't be
+// sent (RFC 3501 section 7.4.1). COPY is included since its sequence
+// numbers would no longer match either. The UID versions are exempt.
+var holdExpunge = map[string]bool{
+	"copy":   true,
+	"fetch":  true,
+	"search": true,
+	"store":  true,
+}
+
+func init() {
+	commands = map[string]*command{
+		// 6.1. Client Commands - Any State
+		"capability": {stateAny, (*session).cmdCapability},
+		"noop":       {stateAny, (*session).cmdNoop},
+		"logout":     {stateAny, (*session).cmdLogout},
+		// 6.2. Client Commands - Not Authenticated State
+		"starttls":     {stateNotAuthenticated, (*session).cmdStartTLS},
+		"authenticate": {stateNotAuthenticated, (*session).cmdAuthenticate},
+		"login":        {stateNotAuthenticated, (*session).cmdLogin},
+		// 6.3. Client Commands - Authenticated State
+		"select":      {stateAuthOrSelected, (*session).cmdSelect},
+		"examine":     {stateAuthOrSelected, (*session).cmdExamine},
+		"create":      {stateAuthOrSelected, (*session).cmdCreate},
+		"delete":      {stateAuthOrSelected, (*session).cmdDelete},
+		"rename":      {stateAuthOrSelected, (*session).cmdRename},
+		"subscribe":   {stateAuthOrSelected, (*session).cmdSubscribe},
+		"unsubscribe": {stateAuthOrSelected, (*session).cmdUnsubscribe},
+		"list":        {stateAuthOrSelected, (*session).cmdList},
+		"lsub":        {stateAuthOrSelected, (*session).cmdLsub},
+		"status":      {stateAuthOrSelected, (*session).cmdStatus},
+		"append":      {stateAuthOrSelected, (*session).cmdAppend},
+		// 6.4. Client Commands - Selected State
+		"check":   {stateSelected, (*session).cmdCheck},
+		"close":   {stateSelected, (*session).cmdClose},
+		"expunge": {stateSelected, (*session).cmdExpunge},
+		"store":   {stateSelected, (*session).cmdStore},
+		"copy":    {stateSelected, (*session).cmdCopy},
+		"fetch":   {stateSelected, (*session).cmdFetch},
+		"search":  {stateSelected, (*session).cmdSearch},
+		"uid":     {stateSelected, (*session).cmdUID},
+		// RFC 2177 - IMAP4 IDLE command
+		"idle": {stateAuthOrSelected, (*session).cmdIdle},
+	}
+	uidCommands = map[string]*command{
+		"copy":   {stateSelected, (*session).cmdUIDCopy},
+		"fetch":  {stateSelected, (*session).cmdUIDFetch},
+		"search": {stateSelected, (*session).cmdUIDSearch},
+		"store":  {stateSelected, (*session).cmdUIDStore},
+	}
+}
+
+// dispatch runs the named command from the table if it's valid in the
+// current state.
+func (s *session) dispatch(table map[string]*command, tag, cmd string, args []arg) {
+	c := table[cmd]
+	switch {
+	case c == nil:
+		s.sendlinef("%s BAD Unknown command", tag)
+	case c.states&s.state != 0:
+		c.handler(s, tag, args)
+	case s.state == stateNotAuthenticated:
+		s.sendlinef("%s BAD Not authenticated", tag)
+	case c.states == stateNotAuthenticated:
+		s.sendlinef("%s BAD Already authenticated", tag)
+	default:
+		s.sendlinef("%s BAD No mailbox selected", tag)
+	}
+}
+
+func (s *session) cmdCapability(tag string, args []arg) {
+	s.sendUntagged(append(List{Atom("CAPABILITY")}, atoms(s.capabilities())...)...)
+	s.sendlinef("%s OK CAPABILITY completed", tag)
+}
+
+func (s *session) cmdNoop(tag string, args []arg) {
+	s.sendPolledUpdates()
+	s.sendlinef("%s OK NOOP completed", tag)
+}
+
+// sendPolledUpdates sends the changes of the selected mailbox including
+// the ones found by polling a mailbox that isn't a Notifier.
+func (s *session) sendPolledUpdates() {
+	if err := s.poll(false); err != nil {
+		s.errorf("Error polling mailbox %s: %+v", s.name, err)
+	}
+	if err := s.sendUpdates(true); err != nil {
+		s.errorf("Error sending updates: %+v", err)
+	}
+}
+
+// sendAdded sends EXISTS for messages the session added to the selected
+// mailbox with APPEND or COPY (RFC 3501 section 6.3.11), which a Notifier
+// doesn't report.
+func (s *session) sendAdded(name string) {
+	if !s.isSelected(name) {
+		return
+	}
+	if err := s.poll(true); err != nil {
+		s.errorf("Error polling mailbox %s: %+v", s.name, err)
+	}
+	// COPY may be using sequence numbers.
+	if err := s.sendUpdates(false); err != nil {
+		s.errorf("Error sending updates: %+v", err)
+	}
+}
+
+func (s *session) cmdLogout(tag string, args []arg) {
+	s.sendlinef("* BYE LOGOUT Requested")
+	s.sendlinef("%s OK %d good day (Success)", tag, 0)
+	s.state = stateLogout
+}
+
+func (s *session) cmdStartTLS(tag string, args []arg) {
+	if s.secure {
+		s.sendlinef("%s NO connection already secure", tag)
+	} else if s.srv.TlsConfig == nil {
+		s.sendlinef("%s NO TLS not configured", tag)
+	} else {
+		s.sendlinef("%s OK Begin TLS negotiation now", tag)
+		s.bw.Flush()
+		c := tls.Server(s.rwc, s.srv.TlsConfig)
+		if err := c.Handshake(); err != nil {
+			s.errorf("TLS handshake failed: %+v", err)
+			s.state = stateLogout
+			return
+		}
+		s.rwc = c
+		s.br = bufio.NewReader(c)
+		s.bw = bufio.NewWriter(c)
+		s.p.br = s.br
+		s.secure = true
+	}
+}
+
+// 6.2.2 - AUTHENTICATE [mechanism] [initial response]
+func (s *session) cmdAuthenticate(tag string, args []arg) {
+	if len(args) < 1 || len(args) > 2 || args[0].kind != argAtom {
+		s.sendlinef("%s BAD Missing authentication mechanism", tag)
+	} else if m := s.saslMechanism(strings.ToUpper(args[0].str)); m == nil {
+		s.sendlinef("%s NO Unsupported authentication mechanism", tag)
+	} else if len(args) == 1 {
+		s.sendLoginResult(tag, s.authenticate(m, nil))
+	} else if ir, ok := args[1].astring(); !ok {
+		s.sendlinef("%s BAD Invalid initial response", tag)
+	} else if ir == "=" {
+		s.sendLoginResult(tag, s.authenticate(m, []byte{}))
+	} else if initial, err := base64.StdEncoding.DecodeString(ir); err != nil {
+		s.sendlinef("%s BAD Invalid initial response", tag)
+	} else {
+		s.sendLoginResult(tag, s.authenticate(m, initial))
+	}
+}
+
+// 6.2.3 - LOGIN [user name] [password]
+func (s *session) cmdLogin(tag string, args []arg) {
+	username, ok := "", len(args) == 2
+	password := ""
+	if ok {
+		username, ok = args[0].astring()
+	}
+	if ok {
+		password, ok = args[1].astring()
+	}
+	if !ok {
+		s.sendlinef("%s BAD Missing username and password", tag)
+	} else if s.secure || s.srv.InsecureLogin {
+		b, err := s.srv.login(username, password)
+		if err == nil {
+			s.setUser(username, b)
+		}
+		s.sendLoginResult(tag, err)
+	} else {
+		s.sendlinef("%s NO Login only supported over a secure connection", tag)
+	}
+}
+
+// 6.3.1 - SELECT [mailbox name]
+func (s *session) cmdSelect(tag string, args []arg) {
+	s.selectMailbox(tag, args, false)
+}
+
+// 6.3.2 - EXAMINE [mailbox name]
+func (s *session) cmdExamine(tag string, args []arg) {
+	s.selectMailbox(tag, args, true)
+}
+
+func (s *session) selectMailbox(tag string, args []arg, readOnly bool) {
+	name, ok := "", len(args) == 1
+	if ok {
+		name, ok = args[0].astring()
+	}
+	if !ok {
+		s.sendlinef("%s BAD Missing mailbox name", tag)
+		return
+	}
+	// A failed SELECT leaves no mailbox selected.
+	s.unselect()
+	mb, err := s.backend.Mailbox(name)
+	if err != nil {
+		if err == ErrUnknownMailbox {
+			s.sendlinef("%s NO unknown mailbox", tag)
+		} else {
+			s.errorf("Error selecting mailbox %s: %+v", name, err)
+			s.sendlinef("%s NO internal error", tag)
+		}
+		return
+	}
+	info, err := mb.Info()
+	if err != nil {
+		s.errorf("Error getting info for mailbox %s: %+v", name, err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	s.mailbox = mb
+	// Watch before listing the messages so that no change is missed.
+	s.watch()
+	if err := s.loadUIDs(); err != nil {
+		s.errorf("Error listing messages of mailbox %s: %+v", name, err)
+		s.sendlinef("%s NO internal error", tag)
+		s.unselect()
+		return
+	}
+	s.name = name
+	s.readOnly = readOnly || info.ReadOnly
+	s.recent = info.Recent
+	s.state = stateSelected
+	s.sendUntagged(Atom("FLAGS"), atoms([]string{FlagAnswered, FlagFlagged, FlagDraft, FlagDeleted, FlagSeen}))
+	if s.readOnly {
+		s.sendlinef(`* OK [PERMANENTFLAGS ()] No permanent flags permitted`)
+	} else {
+		s.sendlinef(`* OK [PERMANENTFLAGS (\Answered \Flagged \Draft \Deleted \Seen \*)]`)
+	}
+	s.sendlinef(`* OK [UIDVALIDITY %d]`, info.UidValidity)
+	s.sendlinef(`* OK [UIDNEXT %d]`, info.NextUid)
+	// s.sendlinef("* OK [UNSEEN %d]", ...) // The message sequence number of the first unseen message in the mailbox.
+	// The count has to match the listed messages which may have changed
+	// since the info was read.
+	s.sendUntagged(Number64(len(s.uids)), Atom("EXISTS"))
+	s.sendUntagged(Number64(info.Recent), Atom("RECENT"))
+	if s.readOnly {
+		s.sendlinef("%s OK [READ-ONLY] Completed", tag)
+		return
+	}
+	if rc, ok := mb.(RecentClearer); ok {
+		if err := rc.ClearRecent(); err != nil {
+			s.errorf("Error clearing recent flags of mailbox %s: %+v", name, err)
+		}
+	}
+	s.sendlinef("%s OK [READ-WRITE] Completed", tag)
+}
+
+// unselect returns to the authenticated state.
+func (s *session) unselect() {
+	s.unwatch()
+	s.mailbox = nil
+	s.name = ""
+	s.readOnly = false
+	s.uids = nil
+	s.recent = 0
+	if s.state == stateSelected {
+		s.state = stateAuthenticated
+	}
+}
+
+// mailboxManager returns the backend's MailboxManager or sends a NO
+// response if mailboxes can't be managed.
+func (s *session) mailboxManager(tag string) MailboxManager {
+	mm, ok := s.backend.(MailboxManager)
+	if !ok {
+		s.sendlinef("%s NO Mailbox management not supported", tag)
+	}
+	return mm
+}
+
+// sendMailboxError sends the tagged response for a failed mailbox
+// management command.
+func (s *session) sendMailboxError(tag, cmd, name string, err error) {
+	switch err {
+	case ErrUnknownMailbox:
+		s.sendlinef("%s NO [NONEXISTENT] Mailbox does not exist", tag)
+	case ErrMailboxExists:
+		s.sendlinef("%s NO [ALREADYEXISTS] Mailbox already exists", tag)
+	default:
+		s.errorf("Error in %s of mailbox %s: %+v", cmd, name, err)
+		s.sendlinef("%s NO internal error", tag)
+	}
+}
+
+// delimiter returns the hierarchy delimiter used by the backend.
+func (s *session) delimiter() (string, error) {
+	mailboxes, err := s.backend.ListMailboxes()
+	if err != nil {
+		return "", err
+	}
+	return listDelimiter(mailboxes), nil
+}
+
+// listDelimiter returns the hierarchy delimiter of listed mailboxes.
+func listDelimiter(mailboxes []*MailboxResponse) string {
+	if len(mailboxes) > 0 {
+		return mailboxes[0].Delimiter
+	}
+	return "/"
+}
+
+// createParents creates any missing superior hierarchical names of name.
+func (s *session) createParents(mm MailboxManager, name, delim string) error {
+	if delim == "" {
+		return nil
+	}
+	parts := strings.Split(name, delim)
+	for i := 1; i < len(parts); i++ {
+		parent := strings.Join(parts[:i], delim)
+		if parent == "" {
+			continue
+		}
+		if err := mm.CreateMailbox(parent); err != nil && err != ErrMailboxExists {
+			return err
+		}
+	}
+	return nil
+}
+
+// 6.3.3 - CREATE [mailbox name]
+func (s *session) cmdCreate(tag string, args []arg) {
+	name, ok := "", len(args) == 1
+	if ok {
+		name, ok = args[0].astring()
+	}
+	if !ok || name == "" {
+		s.sendlinef("%s BAD Missing mailbox name", tag)
+		return
+	}
+	mm := s.mailboxManager(tag)
+	if mm == nil {
+		return
+	}
+	if strings.EqualFold(name, "INBOX") {
+		s.sendlinef("%s NO [ALREADYEXISTS] Mailbox already exists", tag)
+		return
+	}
+	delim, err := s.delimiter()
+	if err != nil {
+		s.sendMailboxError(tag, "CREATE", name, err)
+		return
+	}
+	// A trailing delimiter declares the intent to create names under
+	// this one, which doesn't need to be kept by the backend.
+	if delim != "" {
+		name = strings.TrimSuffix(name, delim)
+	}
+	if err := s.createParents(mm, name, delim); err != nil {
+		s.sendMailboxError(tag, "CREATE", name, err)
+	} else if err := mm.CreateMailbox(name); err != nil {
+		s.sendMailboxError(tag, "CREATE", name, err)
+	} else {
+		s.sendlinef("%s OK CREATE completed", tag)
+	}
+}
+
+// 6.3.4 - DELETE [mailbox name]
+func (s *session) cmdDelete(tag string, args []arg) {
+	name, ok := "", len(args) == 1
+	if ok {
+		name, ok = args[0].astring()
+	}
+	if !ok {
+		s.sendlinef("%s BAD Missing mailbox name", tag)
+		return
+	}
+	mm := s.mailboxManager(tag)
+	if mm == nil {
+		return
+	}
+	if strings.EqualFold(name, "INBOX") {
+		s.sendlinef("%s NO Cannot delete INBOX", tag)
+		return
+	}
+	mailboxes, err := s.backend.ListMailboxes()
+	if err != nil {
+		s.sendMailboxError(tag, "DELETE", name, err)
+		return
+	}
+	// It is an error to delete a \Noselect name with inferior names.
+	for _, mb := range mailboxes {
+		if mb.Name == name && mb.Noselect && mb.Delimiter != "" {
+			for _, child := range mailboxes {
+				if strings.HasPrefix(child.Name, name+mb.Delimiter) {
+					s.sendlinef("%s NO [HASCHILDREN] Mailbox has inferior hierarchical names", tag)
+					return
+				}
+			}
+		}
+	}
+	if err := mm.DeleteMailbox(name); err != nil {
+		s.sendMailboxError(tag, "DELETE", name, err)
+	} else {
+		s.sendlinef("%s OK DELETE completed", tag)
+	}
+}
+
+// 6.3.5 - RENAME [existing mailbox name] [new mailbox name]
+func (s *session) cmdRename(tag string, args []arg) {
+	oldName, newName, ok := "", "", len(args) == 2
+	if ok {
+		oldName, ok = args[0].astring()
+	}
+	if ok {
+		newName, ok = args[1].astring()
+	}
+	if !ok || newName == "" {
+		s.sendlinef("%s BAD Missing mailbox names", tag)
+		return
+	}
+	mm := s.mailboxManager(tag)
+	if mm == nil {
+		return
+	}
+	if strings.EqualFold(oldName, "INBOX") {
+		oldName = "INBOX"
+	}
+	if strings.EqualFold(newName, "INBOX") {
+		s.sendlinef("%s NO [ALREADYEXISTS] Mailbox already exists", tag)
+		return
+	}
+	mailboxes, err := s.backend.ListMailboxes()
+	if err != nil {
+		s.sendMailboxError(tag, "RENAME", oldName, err)
+		return
+	}
+	// Superior names of the new name are only created once the rename
+	// is known to be valid. INBOX always exists even if not listed.
+	exists := oldName == "INBOX"
+	for _, mb := range mailboxes {
+		if mb.Name == newName {
+			s.sendMailboxError(tag, "RENAME", oldName, ErrMailboxExists)
+			return
+		}
+		if mb.Name == oldName {
+			exists = true
+		}
+	}
+	if !exists {
+		s.sendMailboxError(tag, "RENAME", oldName, ErrUnknownMailbox)
+		return
+	}
+	if err := s.createParents(mm, newName, listDelimiter(mailboxes)); err != nil {
+		s.sendMailboxError(tag, "RENAME", oldName, err)
+	} else if err := mm.RenameMailbox(oldName, newName); err != nil {
+		s.sendMailboxError(tag, "RENAME", oldName, err)
+	} else {
+		s.sendlinef("%s OK RENAME completed", tag)
+	}
+}
+
+// 6.3.8 - LIST [reference name] [mailbox name with possible wildcards]
+func (s *session) cmdList(tag string, args []arg) {
+	s.list(tag, "LIST", args)
+}
+
+// 6.3.9 - LSUB [reference name] [mailbox name with possible wildcards]
+func (s *session) cmdLsub(tag string, args []arg) {
+	s.list(tag, "LSUB", args)
+}
+
+func (s *session) list(tag, cmd string, args []arg) {
+	reference, pattern, ok := "", "", len(args) == 2
+	if ok {
+		reference, ok = args[0].astring()
+	}
+	if ok {
+		pattern, ok = args[1].astring()
+	}
+	if !ok {
+		s.sendlinef("%s BAD Missing reference and mailbox name", tag)
+		return
+	}
+	mailboxes, err := s.backend.ListMailboxes()
+	if err != nil {
+		s.errorf("Error listing mailboxes: %+v", err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	delim := "/"
+	if len(mailboxes) > 0 {
+		delim = mailboxes[0].Delimiter
+	}
+	if sub, ok := s.backend.(Subscriber); ok && cmd == "LSUB" {
+		if mailboxes, err = subscribedMailboxes(sub, mailboxes, delim); err != nil {
+			s.errorf("Error listing subscriptions: %+v", err)
+			s.sendlinef("%s NO internal error", tag)
+			return
+		}
+	}
+
+	if pattern == "" {
+		// Return the hierarchy delimiter and the root name of the reference.
+		root := ""
+		if i := strings.Index(reference, delim); delim != "" && i >= 0 {
+			root = reference[:i+1]
+		}
+		s.sendUntagged(Atom(cmd), List{Atom(`\Noselect`)}, NString(delim), Quoted(root))
+		s.sendlinef("%s OK %s completed", tag, cmd)
+		return
+	}
+
+	if delim != "" && strings.HasSuffix(reference, delim) && strings.HasPrefix(pattern, delim) {
+		pattern = pattern[len(delim):]
+	}
+	pattern = reference + pattern
+	for _, mb := range matchingMailboxes(mailboxes, pattern) {
+		s.sendUntagged(Atom(cmd), atoms(mailboxAttributes(mb)), NString(mb.Delimiter), Quoted(mb.Name))
+	}
+	s.sendlinef("%s OK %s completed", tag, cmd)
+}
+
+// subscribedMailboxes returns the subscribed mailboxes with the attributes
+// of the existing mailboxes. Subscriptions to mailboxes that don't exist
+// are returned with \Noselect.
+func subscribedMailboxes(sub Subscriber, mailboxes []*MailboxResponse, delim string) ([]*MailboxResponse, error) {
+	names, err := sub.Subscriptions()
+	if err != nil {
+		return nil, err
+	}
+	existing := make(map[string]*MailboxResponse, len(mailboxes))
+	for _, mb := range mailboxes {
+		existing[mb.Name] = mb
+	}
+	out := make([]*MailboxResponse, len(names))
+	for i, name := range names {
+		if mb := existing[name]; mb != nil {
+			out[i] = mb
+		} else {
+			out[i] = &MailboxResponse{Name: name, Delimiter: delim, Noselect: true}
+		}
+	}
+	return out, nil
+}
+
+// 6.3.6 - SUBSCRIBE [mailbox]
+func (s *session) cmdSubscribe(tag string, args []arg) {
+	s.subscribe(tag, "SUBSCRIBE", args)
+}
+
+// 6.3.7 - UNSUBSCRIBE [mailbox name]
+func (s *session) cmdUnsubscribe(tag string, args []arg) {
+	s.subscribe(tag, "UNSUBSCRIBE", args)
+}
+
+func (s *session) subscribe(tag, cmd string, args []arg) {
+	name, ok := "", len(args) == 1
+	if ok {
+		name, ok = args[0].astring()
+	}
+	if !ok {
+		s.sendlinef("%s BAD Missing mailbox name", tag)
+		return
+	}
+	sub, ok := s.backend.(Subscriber)
+	if !ok {
+		s.sendlinef("%s NO Subscriptions not supported", tag)
+		return
+	}
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	var err error
+	if cmd == "SUBSCRIBE" {
+		err = sub.Subscribe(name)
+	} else {
+		err = sub.Unsubscribe(name)
+	}
+	if err != nil {
+		s.sendMailboxError(tag, cmd, name, err)
+	} else {
+		s.sendlinef("%s OK %s completed", tag, cmd)
+	}
+}
+
+// matchingMailboxes returns the mailboxes matching pattern. Levels of
+// hierarchy that don't exist themselves are included with \Noselect when
+// they match the pattern while some of their inferior names don't, such
+// as with a trailing % wildcard.
+func matchingMailboxes(mailboxes []*MailboxResponse, pattern string) []*MailboxResponse {
+	names := make(map[string]bool, len(mailboxes))
+	for _, mb := range mailboxes {
+		names[mb.Name] = true
+	}
+	out := make([]*MailboxResponse, 0)
+	for _, mb := range mailboxes {
+		match := matchMailbox(pattern, mb.Name, mb.Delimiter)
+		if !match && mb.Delimiter != "" {
+			parts := strings.Split(mb.Name, mb.Delimiter)
+			for i := 1; i < len(parts); i++ {
+				parent := strings.Join(parts[:i], mb.Delimiter)
+				if !names[parent] && matchMailbox(pattern, parent, mb.Delimiter) {
+					names[parent] = true
+					out = append(out, &MailboxResponse{Name: parent, Delimiter: mb.Delimiter, Noselect: true})
+				}
+			}
+		}
+		if match {
+			out = append(out, mb)
+		}
+	}
+	return out
+}
+
+func mailboxAttributes(mb *MailboxResponse) []string {
+	attrs := []string{}
+	if mb.Noinferiors {
+		attrs = append(attrs, `\Noinferiors`)
+	}
+	if mb.Noselect {
+		attrs = append(attrs, `\Noselect`)
+	}
+	if mb.Marked {
+		attrs = append(attrs, `\Marked`)
+	}
+	return attrs
+}
+
+// 6.3.10 - STATUS [mailbox name] ([status data item names])
+var statusItems = map[string]bool{
+	"MESSAGES":    true,
+	"RECENT":      true,
+	"UIDNEXT":     true,
+	"UIDVALIDITY": true,
+	"UNSEEN":      true,
+}
+
+func (s *session) cmdStatus(tag string, args []arg) {
+	name, ok := "", len(args) == 2 && args[1].kind == argList
+	if ok {
+		name, ok = args[0].astring()
+	}
+	if !ok || len(args[1].list) == 0 {
+		s.sendlinef("%s BAD Missing mailbox and item names", tag)
+		return
+	}
+	for _, it := range args[1].list {
+		if it.kind != argAtom || !statusItems[strings.ToUpper(it.str)] {
+			s.sendlinef("%s BAD Invalid status item %s", tag, it)
+			return
+		}
+	}
+	mb, err := s.backend.Mailbox(name)
+	if err != nil {
+		if err == ErrUnknownMailbox {
+			s.sendlinef("%s NO unknown mailbox", tag)
+		} else {
+			s.errorf("Error selecting mailbox %s: %+v", name, err)
+			s.sendlinef("%s NO internal error", tag)
+		}
+		return
+	}
+	info, err := mb.Info()
+	if err != nil {
+		s.errorf("Error getting info for mailbox %s: %+v", name, err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	var status List
+	for _, it := range args[1].list {
+		item := strings.ToUpper(it.str)
+		switch item {
+		case "MESSAGES":
+			status = append(status, Atom(item), Number64(info.Exists))
+		case "RECENT":
+			status = append(status, Atom(item), Number64(info.Recent))
+		case "UIDNEXT":
+			status = append(status, Atom(item), Number64(info.NextUid))
+		case "UIDVALIDITY":
+			status = append(status, Atom(item), Number64(info.UidValidity))
+		case "UNSEEN":
+			// Number of messages which do not have the \Seen flag set.
+			status = append(status, Atom(item), Number64(info.Unseen))
+		}
+	}
+	s.sendUntagged(Atom("STATUS"), Quoted(name), status)
+	s.sendlinef("%s OK STATUS completed", tag)
+}
+
+// 6.3.11 - APPEND [mailbox name] [OPTIONAL flag parenthesized list]
+// [OPTIONAL date/time string] [message literal]
+func (s *session) cmdAppend(tag string, args []arg) {
+	if len(args) < 2 || len(args) > 4 {
+		s.sendlinef("%s BAD Missing mailbox name and message", tag)
+		return
+	}
+	name, ok := args[0].astring()
+	if !ok {
+		s.sendlinef("%s BAD Invalid mailbox name", tag)
+		return
+	}
+	var err error
+	flags := []string{}
+	date := time.Now()
+	for _, a := range args[1 : len(args)-1] {
+		if a.kind == argList {
+			if flags, ok = parseFlags(a); !ok {
+				s.sendlinef("%s BAD Invalid flags", tag)
+				return
+			}
+		} else if a.kind == argQuoted {
+			if date, err = parseInternalDate(a.str); err != nil {
+				s.sendlinef("%s BAD Invalid date-time", tag)
+				return
+			}
+		} else {
+			s.sendlinef("%s BAD Invalid arguments", tag)
+			return
+		}
+	}
+	message := args[len(args)-1]
+	if message.kind != argLiteral {
+		s.sendlinef("%s BAD Missing message literal", tag)
+		return
+	}
+
+	mb, err := s.backend.Mailbox(name)
+	if err != nil {
+		if err == ErrUnknownMailbox {
+			s.sendlinef("%s NO [TRYCREATE] Mailbox does not exist", tag)
+		} else {
+			s.errorf("Error opening mailbox %s: %+v", name, err)
+			s.sendlinef("%s NO internal error", tag)
+		}
+		return
+	}
+	appender, ok := mb.(Appender)
+	if !ok {
+		s.sendlinef("%s NO [CANNOT] Mailbox does not accept new messages", tag)
+		return
+	}
+	if readOnly, err := s.isReadOnly(name, mb); err != nil {
+		s.errorf("Error getting info for mailbox %s: %+v", name, err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	} else if readOnly {
+		s.sendlinef("%s NO Mailbox is read-only", tag)
+		return
+	}
+	if err := appender.Append(flags, date, []byte(message.str)); err != nil {
+		s.errorf("Error appending to mailbox %s: %+v", name, err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	s.sendAdded(name)
+	s.sendlinef("%s OK APPEND completed", tag)
+}
+
+// isReadOnly reports whether messages can't be added to the named mailbox
+// because it is read-only or it is selected with EXAMINE.
+func (s *session) isReadOnly(name string, mb Mailbox) (bool, error) {
+	if s.readOnly && s.isSelected(name) {
+		return true, nil
+	}
+	info, err := mb.Info()
+	return info.ReadOnly, err
+}
+
+// isSelected reports whether the named mailbox is the selected mailbox.
+func (s *session) isSelected(name string) bool {
+	if s.mailbox == nil {
+		return false
+	}
+	return name == s.name || strings.EqualFold(name, "INBOX") && strings.EqualFold(s.name, "INBOX")
+}
+
+// 6.4.1 - CHECK
+func (s *session) cmdCheck(tag string, args []arg) {
+	// There's no housekeeping to do beyond what NOOP does.
+	s.sendPolledUpdates()
+	s.sendlinef("%s OK CHECK completed", tag)
+}
+
+// 6.4.2 - CLOSE
+func (s *session) cmdClose(tag string, args []arg) {
+	// Messages are removed without sending untagged EXPUNGE responses.
+	if ex, ok := s.mailbox.(Expunger); ok && !s.readOnly {
+		if _, err := ex.Expunge(); err != nil {
+			s.errorf("Error expunging mailbox on close: %+v", err)
+		}
+	}
+	s.unselect()
+	s.sendlinef("%s OK Returned to authenticated state. (Success)", tag)
+}
+
+// 6.4.3 - EXPUNGE
+func (s *session) cmdExpunge(tag string, args []arg) {
+	if s.readOnly {
+		s.sendlinef("%s NO Mailbox is read-only", tag)
+		return
+	}
+	ex, ok := s.mailbox.(Expunger)
+	if !ok {
+		s.sendlinef("%s NO [CANNOT] Messages can not be removed from this mailbox", tag)
+		return
+	}
+	uids, err := ex.Expunge()
+	if err != nil {
+		s.errorf("Error expunging mailbox: %+v", err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	// Each removal renumbers the messages that follow it.
+	for _, uid := range uids {
+		if seqNum := s.expunged(uid); seqNum != 0 {
+			s.sendUntagged(Number64(seqNum), Atom("EXPUNGE"))
+		}
+	}
+	s.sendlinef("%s OK EXPUNGE completed", tag)
+}
+
+// 6.4.6 - STORE [sequence set] [message data item name] [value for message data item]
+func (s *session) cmdStore(tag string, args []arg) {
+	s.store(tag, args, false)
+}
+
+// UID STORE [uid set] [message data item name] [value for message data item]
+func (s *session) cmdUIDStore(tag string, args []arg) {
+	s.store(tag, args, true)
+}
+
+func (s *session) store(tag string, args []arg, uid bool) {
+	if len(args) < 3 || args[0].kind != argAtom || args[1].kind != argAtom {
+		s.sendlinef("%s BAD Missing sequence set, item name and flags", tag)
+		return
+	}
+	set := parseRangeSet(args[0].str)
+	if set == nil {
+		s.sendlinef("%s BAD invalid range", tag)
+		return
+	}
+	item := strings.ToUpper(args[1].str)
+	silent := strings.HasSuffix(item, ".SILENT")
+	var mode StoreMode
+	switch strings.TrimSuffix(item, ".SILENT") {
+	case "FLAGS":
+		mode = StoreReplace
+	case "+FLAGS":
+		mode = StoreAdd
+	case "-FLAGS":
+		mode = StoreRemove
+	default:
+		s.sendlinef("%s BAD Invalid message data item name", tag)
+		return
+	}
+	// The flags may be given as a list or as space separated flags.
+	value := args[2]
+	if len(args) > 3 || value.kind != argList {
+		value = arg{kind: argList, list: args[2:]}
+	}
+	flags, ok := parseFlags(value)
+	if !ok {
+		s.sendlinef("%s BAD Invalid flags", tag)
+		return
+	}
+
+	if s.readOnly {
+		s.sendlinef("%s NO Mailbox is read-only", tag)
+		return
+	}
+	storer, ok := s.mailbox.(FlagStorer)
+	if !ok {
+		s.sendlinef("%s NO [CANNOT] Flags can not be changed in this mailbox", tag)
+		return
+	}
+	res, err := storer.StoreFlags(s.uidSet(set, uid), mode, flags)
+	if err != nil {
+		s.errorf("Error storing flags %s: %+v", args[0].str, err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	if !silent {
+		for _, m := range res {
+			seqNum := s.seqNum(m.UID)
+			if seqNum == 0 {
+				continue
+			}
+			data := List{Atom("FLAGS"), atoms(m.Flags)}
+			if uid {
+				data = append(data, Atom("UID"), Number64(m.UID))
+			}
+			s.sendUntagged(Number64(seqNum), Atom("FETCH"), data)
+		}
+	}
+	s.sendlinef("%s OK STORE completed", tag)
+}
+
+// 6.4.7 - COPY [sequence set] [mailbox name]
+func (s *session) cmdCopy(tag string, args []arg) {
+	s.copy(tag, args, false)
+}
+
+// UID COPY [uid set] [mailbox name]
+func (s *session) cmdUIDCopy(tag string, args []arg) {
+	s.copy(tag, args, true)
+}
+
+func (s *session) copy(tag string, args []arg, uid bool) {
+	name, ok := "", len(args) == 2 && args[0].kind == argAtom
+	if ok {
+		name, ok = args[1].astring()
+	}
+	if !ok {
+		s.sendlinef("%s BAD Missing sequence set and mailbox name", tag)
+		return
+	}
+	set := parseRangeSet(args[0].str)
+	if set == nil {
+		s.sendlinef("%s BAD invalid range", tag)
+		return
+	}
+	dest, err := s.backend.Mailbox(name)
+	if err != nil {
+		if err == ErrUnknownMailbox {
+			s.sendlinef("%s NO [TRYCREATE] Mailbox does not exist", tag)
+		} else {
+			s.errorf("Error opening mailbox %s: %+v", name, err)
+			s.sendlinef("%s NO internal error", tag)
+		}
+		return
+	}
+	if readOnly, err := s.isReadOnly(name, dest); err != nil {
+		s.errorf("Error getting info for mailbox %s: %+v", name, err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	} else if readOnly {
+		s.sendlinef("%s NO Mailbox is read-only", tag)
+		return
+	}
+	if copier, ok := s.mailbox.(Copier); ok {
+		err = copier.CopyMessages(s.uidSet(set, uid), dest)
+	} else if _, ok := dest.(Appender); ok {
+		err = s.copyByAppend(s.uidSet(set, uid), dest)
+	} else {
+		s.sendlinef("%s NO [CANNOT] Mailbox does not accept new messages", tag)
+		return
+	}
+	if err == errCopyNotUndoable {
+		s.sendlinef("%s NO [CANNOT] Messages can not be copied to this mailbox", tag)
+		return
+	} else if err != nil {
+		s.errorf("Error copying %s to mailbox %s: %+v", args[0].str, name, err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	s.sendAdded(name)
+	s.sendlinef("%s OK COPY completed", tag)
+}
+
+var copyItems = []MessageDataItemName{{Name: "FLAGS"}, {Name: "INTERNALDATE"}, {Name: "BODY.PEEK[]"}}
+
+// errCopyNotUndoable is returned by copyByAppend for several messages if
+// the destination couldn't remove them after a failure.
+var errCopyNotUndoable = errors.New("imapd: copy can't be undone")
+
+// copiedMessage is a message read to be copied by appending.
+type copiedMessage struct {
+	flags   []string
+	date    time.Time
+	message []byte
+}
+
+// copyByAppend copies messages from the selected mailbox by appending them
+// in sequence number order. A failed COPY must leave the destination
+// unchanged (RFC 3501 section 6.4.7), so all messages are read before the
+// first is appended and the ones appended before a failure are removed.
+// Removing them needs a destination that is a FlagStorer and Expunger.
+func (s *session) copyByAppend(uids []Range, dest Mailbox) error {
+	var msgs []copiedMessage
+	err := s.mailbox.FetchMessages(uids, copyItems, func(uid uint32, data []MessageDataItem) error {
+		m := copiedMessage{flags: []string{}, date: time.Now()}
+		for _, v := range data {
+			switch t := v.Data.(type) {
+			case []string:
+				for _, f := range t {
+					if f != FlagReceent {
+						m.flags = append(m.flags, f)
+					}
+				}
+			case time.Time:
+				m.date = t
+			case []byte:
+				m.message = t
+			}
+		}
+		msgs = append(msgs, m)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	_, storer := dest.(FlagStorer)
+	_, expunger := dest.(Expunger)
+	if len(msgs) > 1 && (!storer || !expunger) {
+		return errCopyNotUndoable
+	}
+	info, err := dest.Info()
+	if err != nil {
+		return err
+	}
+	for i, m := range msgs {
+		if err := dest.(Appender).Append(m.flags, m.date, m.message); err != nil {
+			if i > 0 {
+				if err := removeCopies(dest, info.NextUid, msgs[:i]); err != nil {
+					s.errorf("Error removing copied messages: %+v", err)
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+var removeCopiesItems = []MessageDataItemName{{Name: "FLAGS"}, {Name: "INTERNALDATE"}, {Name: "RFC822.SIZE"}}
+
+// removeCopies removes the messages of a failed copy from dest. They have
+// a UID of at least next and are told apart from messages delivered
+// meanwhile by their size and internal date.
+func removeCopies(dest Mailbox, next uint32, msgs []copiedMessage) error {
+	info, err := dest.Info()
+	if err != nil {
+		return err
+	}
+	if info.NextUid <= 1 {
+		return errors.New("imapd: copied messages not found")
+	}
+	var copies, deleted []Range
+	i := 0
+	all := []Range{{Start: 1, End: info.NextUid - 1}}
+	err = dest.FetchMessages(all, removeCopiesItems, func(uid uint32, data []MessageDataItem) error {
+		var flags []string
+		var date time.Time
+		size := -1
+		for _, v := range data {
+			switch t := v.Data.(type) {
+			case []string:
+				flags = t
+			case time.Time:
+				date = t
+			case int:
+				size = t
+			case uint32:
+				size = int(t)
+			}
+		}
+		if uid >= next && i < len(msgs) && size == len(msgs[i].message) && date.Unix() == msgs[i].date.Unix() {
+			copies = append(copies, Range{Start: uid})
+			i++
+		} else if hasFlag(flags, FlagDeleted) {
+			deleted = append(deleted, Range{Start: uid})
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if i < len(msgs) {
+		return errors.New("imapd: copied messages not found")
+	}
+	// Expunge removes every message with the \Deleted flag, so it's
+	// cleared from the other messages until the copies are removed.
+	storer := dest.(FlagStorer)
+	if len(deleted) > 0 {
+		if _, err := storer.StoreFlags(deleted, StoreRemove, []string{FlagDeleted}); err != nil {
+			return err
+		}
+	}
+	if _, err = storer.StoreFlags(copies, StoreAdd, []string{FlagDeleted}); err == nil {
+		_, err = dest.(Expunger).Expunge()
+	}
+	if len(deleted) > 0 {
+		if _, err := storer.StoreFlags(deleted, StoreAdd, []string{FlagDeleted}); err != nil {
+			return err
+		}
+	}
+	return err
+}
+
+// 6.4.8 - UID [command] [arguments]
+func (s *session) cmdUID(tag string, args []arg) {
+	if len(args) < 1 || args[0].kind != argAtom {
+		s.sendlinef("%s BAD Missing command", tag)
+		return
+	}
+	s.dispatch(uidCommands, tag, strings.ToLower(args[0].str), args[1:])
+}
+
+// RFC 2177 - IDLE
+func (s *session) cmdIdle(tag string, args []arg) {
+	if len(args) != 0 {
+		s.sendlinef("%s BAD Unexpected arguments", tag)
+		return
+	}
+	if err := s.sendlinef("+ idling"); err != nil {
+		return
+	}
+	if s.srv.ReadTimeout != 0 {
+		s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
+	}
+	type result struct {
+		line string
+		err  error
+	}
+	done := make(chan result, 1)
+	go func() {
+		line, err := s.p.readLine()
+		done <- result{line, err}
+	}()
+	s.sendPolledUpdates()
+	// A mailbox that doesn't report changes is listed periodically.
+	var poll <-chan time.Time
+	if _, ok := s.mailbox.(Notifier); s.mailbox != nil && !ok {
+		ticker := time.NewTicker(s.srv.pollInterval())
+		defer ticker.Stop()
+		poll = ticker.C
+	}
+	for {
+		select {
+		case <-poll:
+			s.sendPolledUpdates()
+		case <-s.updated:
+			if err := s.sendUpdates(true); err != nil {
+				s.errorf("Error sending updates: %+v", err)
+			}
+		case r := <-done:
+			if _, ok := r.err.(syntaxError); ok {
+				s.sendlinef("%s BAD %s", tag, r.err.Error())
+			} else if r.err != nil {
+				// The next command fails to read as well and ends the session.
+				s.errorf("read error: %v", r.err)
+			} else if !strings.EqualFold(r.line, "DONE") {
+				s.sendlinef("%s BAD Expected DONE", tag)
+			} else {
+				s.sendlinef("%s OK IDLE terminated", tag)
+			}
+			return
+		}
+	}
+}
+
+// 6.4.4 - SEARCH [OPTIONAL [CHARSET] specification] [searching criteria (one or more)]
+func (s *session) cmdSearch(tag string, args []arg) {
+	s.search(tag, args, false)
+}
+
+// UID SEARCH [OPTIONAL [CHARSET] specification] [searching criteria (one or more)]
+func (s *session) cmdUIDSearch(tag string, args []arg) {
+	s.search(tag, args, true)
+}
+
+func (s *session) search(tag string, args []arg, uid bool) {
+	criteria, err := parseSearchCriteria(args)
+	if err == errBadCharset {
+		s.sendlinef("%s NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset", tag)
+		return
+	} else if err != nil {
+		s.sendlinef("%s BAD %s", tag, err.Error())
+		return
+	}
+	s.resolveSearchKeys(criteria.Keys)
+	var uids []uint32
+	if searcher, ok := s.mailbox.(Searcher); ok {
+		uids, err = searcher.Search(criteria)
+	} else {
+		uids, err = s.searchByFetch(criteria)
+	}
+	if err != nil {
+		s.errorf("Error searching: %+v", err)
+		s.sendlinef("%s NO internal error", tag)
+		return
+	}
+	results := make([]uint32, 0, len(uids))
+	for _, u := range uids {
+		if seqNum := s.seqNum(u); seqNum != 0 {
+			if uid {
+				results = append(results, u)
+			} else {
+				results = append(results, seqNum)
+			}
+		}
+	}
+	sort.Slice(results, func(i, j int) bool { return results[i] < results[j] })
+	values := List{Atom("SEARCH")}
+	for _, n := range results {
+		values = append(values, Number64(n))
+	}
+	s.sendUntagged(values...)
+	s.sendlinef("%s OK SEARCH completed", tag)
+}
+
+// resolveSearchKeys converts sequence sets to UID sets and resolves * in
+// UID sets.
+func (s *session) resolveSearchKeys(keys []SearchKey) {
+	for i := range keys {
+		switch keys[i].Name {
+		case "SEQ":
+			keys[i].Name = "UID"
+			keys[i].Set = s.uidSet(keys[i].Set, false)
+		case "UID":
+			keys[i].Set = s.uidSet(keys[i].Set, true)
+		default:
+			s.resolveSearchKeys(keys[i].Keys)
+		}
+	}
+}
+
+// searchByFetch searches the selected mailbox by fetching the data needed
+// to evaluate the criteria for every message.
+func (s *session) searchByFetch(criteria *SearchCriteria) ([]uint32, error) {
+	if len(s.uids) == 0 {
+		return nil, nil
+	}
+	items := []MessageDataItemName{}
+	flags, date, size, message := criteria.needs()
+	if flags {
+		items = append(items, MessageDataItemName{Name: "FLAGS"})
+	}
+	if date {
+		items = append(items, MessageDataItemName{Name: "INTERNALDATE"})
+	}
+	if size {
+		items = append(items, MessageDataItemName{Name: "RFC822.SIZE"})
+	}
+	if message {
+		items = append(items, MessageDataItemName{Name: "BODY.PEEK[]"})
+	}
+	all := []Range{{Start: s.uids[0], End: s.uids[len(s.uids)-1]}}
+	uids := []uint32{}
+	err := s.mailbox.FetchMessages(all, items, func(uid uint32, data []MessageDataItem) error {
+		m := &SearchMessage{UID: uid}
+		for _, v := range data {
+			switch t := v.Data.(type) {
+			case int:
+				m.Size = uint32(t)
+			case uint32:
+				m.Size = t
+			case []string:
+				m.Flags = t
+			case time.Time:
+				m.InternalDate = t
+			case []byte:
+				m.Message = t
+			}
+		}
+		if criteria.Match(m) {
+			uids = append(uids, m.UID)
+		}
+		return nil
+	})
+	return uids, err
+}
+
+// 6.4.5 - FETCH [sequence set] [message data item names or macro]
+func (s *session) cmdFetch(tag string, args []arg) {
+	s.fetch(tag, args, false)
+}
+
+// UID FETCH [uid set] [message data item names or macro]
+func (s *session) cmdUIDFetch(tag string, args []arg) {
+	s.fetch(tag, args, true)
+}
+
+func (s *session) fetch(tag string, args []arg, uid bool) {
+	if len(args) != 2 || args[0].kind != argAtom {
+		s.sendlinef("%s BAD Missing sequence set and item names", tag)
+		return
+	}
+	rangeSet := parseRangeSet(args[0].str)
+	itemNames, err := parseMessageDataItemNames(args[1])
+	if err != nil {
+		s.errorf("Error item names %s: %+v", args[1], err)
+		s.sendlinef("%s BAD invalid item names", tag)
+	} else if rangeSet == nil {
+		s.errorf("Error parsing range set %s", args[0].str)
+		s.sendlinef("%s BAD invalid range", tag)
+	} else {
+		if uid && !hasItem(itemNames, "UID") {
+			// UID FETCH always returns the UID.
+			itemNames = append(itemNames, MessageDataItemName{Name: "UID"})
+		}
+		setSeen := !s.readOnly && setsSeen(itemNames)
+		requestedFlags := hasItem(itemNames, "FLAGS")
+		if setSeen && !requestedFlags {
+			itemNames = append(itemNames, MessageDataItemName{Name: "FLAGS"})
+		}
+		err := s.mailbox.FetchMessages(s.uidSet(rangeSet, uid), itemNames, func(msgUID uint32, items []MessageDataItem) error {
+			seqNum := s.seqNum(msgUID)
+			if seqNum == 0 {
+				return nil
+			}
+			if setSeen {
+				items = s.setSeen(msgUID, items, requestedFlags)
+			}
+			data := make(List, 0, 2*len(items))
+			for _, v := range items {
+				value, err := fetchValue(v.Item, v.Data)
+				if err != nil {
+					return err
+				}
+				data = append(data, Atom(v.Item.responseName()), value)
+			}
+			return s.sendUntagged(Number64(seqNum), Atom("FETCH"), data)
+		})
+		if err != nil {
+			s.errorf("Error fetching %s %s: %+v", args[0], args[1], err)
+			s.sendlinef("%s NO internal error", tag)
+		} else {
+			s.sendlinef("%s OK Success", tag)
+		}
+	}
+}
+
+// setsSeen reports whether fetching the items implicitly sets the \Seen
+// flag.
+func setsSeen(items []MessageDataItemName) bool {
+	for _, it := range items {
+		switch it.Name {
+		case "BODY[]", "RFC822", "RFC822.TEXT":
+			return true
+		}
+	}
+	return false
+}
+
+// setSeen sets the \Seen flag of a fetched message that doesn't have it
+// and updates its FLAGS. The FLAGS of a message that already had the flag
+// are removed unless they were requested.
+func (s *session) setSeen(uid uint32, items []MessageDataItem, requestedFlags bool) []MessageDataItem {
+	var updated []string
+	for _, v := range items {
+		if flags, ok := v.Data.([]string); ok && v.Item.Name == "FLAGS" && !hasFlag(flags, FlagSeen) {
+			if storer, ok := s.mailbox.(FlagStorer); ok {
+				res, err := storer.StoreFlags([]Range{{Start: uid}}, StoreAdd, []string{FlagSeen})
+				if err != nil {
+					s.errorf("Error setting seen flag: %+v", err)
+				}
+				for _, m := range res {
+					if m.UID == uid {
+						updated = m.Flags
+					}
+				}
+			}
+		}
+	}
+	out := items[:0]
+	for _, v := range items {
+		if v.Item.Name == "FLAGS" {
+			if updated != nil {
+				v.Data = updated
+			} else if !requestedFlags {
+				continue
+			}
+		}
+		out = append(out, v)
+	}
+	return out
+}
+
+func hasItem(items []MessageDataItemName, name string) bool {
+	for _, it := range items {
+		if it.Name == name {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,263 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"net/textproto"
+	"strings"
+)
+
+// Address is an address structure of an ENVELOPE. The start of a group is
+// an Address with the group name as Mailbox and no Host, the end of a group
+// is an empty Address.
+type Address struct {
+	Name    string // personal name
+	Route   string // SMTP at-domain-list (source route)
+	Mailbox string
+	Host    string
+}
+
+func (a *Address) appendValue(b []byte) []byte {
+	return List{NString(a.Name), NString(a.Route), NString(a.Mailbox), NString(a.Host)}.appendValue(b)
+}
+
+func (a *Address) String() string {
+	return encodeValue(a)
+}
+
+// Envelope is the ENVELOPE of a message. Fields are kept as they appear in
+// the header so RFC 2047 encoded words are left for the client to decode.
+type Envelope struct {
+	Date      string
+	Subject   string
+	From      []*Address
+	Sender    []*Address
+	ReplyTo   []*Address
+	To        []*Address
+	Cc        []*Address
+	Bcc       []*Address
+	InReplyTo string
+	MessageID string
+}
+
+// ParseEnvelope returns the ENVELOPE of a raw RFC 5322 message. Malformed
+// header fields are skipped rather than reported so that an ENVELOPE can
+// be returned for any message.
+func ParseEnvelope(message []byte) *Envelope {
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(message)))
+	h, _ := r.ReadMIMEHeader()
+	return envelopeFromHeader(h)
+}
+
+func envelopeFromHeader(h textproto.MIMEHeader) *Envelope {
+	e := &Envelope{
+		Date:      h.Get("Date"),
+		Subject:   h.Get("Subject"),
+		From:      parseAddressList(h.Get("From")),
+		Sender:    parseAddressList(h.Get("Sender")),
+		ReplyTo:   parseAddressList(h.Get("Reply-To")),
+		To:        parseAddressList(h.Get("To")),
+		Cc:        parseAddressList(h.Get("Cc")),
+		Bcc:       parseAddressList(h.Get("Bcc")),
+		InReplyTo: h.Get("In-Reply-To"),
+		MessageID: h.Get("Message-Id"),
+	}
+	// Sender and Reply-To default to From (RFC 3501 section 7.4.2).
+	if len(e.Sender) == 0 {
+		e.Sender = e.From
+	}
+	if len(e.ReplyTo) == 0 {
+		e.ReplyTo = e.From
+	}
+	return e
+}
+
+func (e *Envelope) appendValue(b []byte) []byte {
+	return List{
+		NString(e.Date),
+		NString(e.Subject),
+		addressList(e.From),
+		addressList(e.Sender),
+		addressList(e.ReplyTo),
+		addressList(e.To),
+		addressList(e.Cc),
+		addressList(e.Bcc),
+		NString(e.InReplyTo),
+		NString(e.MessageID),
+	}.appendValue(b)
+}
+
+// String returns the ENVELOPE parenthesized list.
+func (e *Envelope) String() string {
+	return encodeValue(e)
+}
+
+// addressList is a list of addresses which unlike a List has no spaces
+// between its elements.
+type addressList []*Address
+
+func (l addressList) appendValue(b []byte) []byte {
+	if len(l) == 0 {
+		return append(b, "NIL"...)
+	}
+	b = append(b, '(')
+	for _, a := range l {
+		b = a.appendValue(b)
+	}
+	return append(b, ')')
+}
+
+type addrToken struct {
+	kind byte // 'a' for an atom, 'q' for a quoted string or the special character
+	s    string
+}
+
+// lexAddresses splits an address list into atoms, quoted strings and the
+// special characters <>@,;: dropping comments.
+func lexAddresses(s string) []addrToken {
+	var toks []addrToken
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == ' ' || c == '\t' || c == '\r' || c == '\n':
+			i++
+		case c == '(':
+			for depth := 0; i < len(s); i++ {
+				if s[i] == '\\' {
+					i++
+				} else if s[i] == '(' {
+					depth++
+				} else if s[i] == ')' {
+					if depth--; depth == 0 {
+						i++
+						break
+					}
+				}
+			}
+		case c == '"':
+			var b strings.Builder
+			for i++; i < len(s) && s[i] != '"'; i++ {
+				if s[i] == '\\' && i+1 < len(s) {
+					i++
+				}
+				b.WriteByte(s[i])
+			}
+			i++
+			toks = append(toks, addrToken{'q', b.String()})
+		case strings.IndexByte("<>@,;:", c) >= 0:
+			toks = append(toks, addrToken{c, ""})
+			i++
+		default:
+			j := i
+			for j < len(s) && strings.IndexByte(" \t\r\n()\"<>@,;:", s[j]) < 0 {
+				if s[j] == '[' {
+					// Domain literals may contain special characters.
+					for j < len(s)-1 && s[j] != ']' {
+						j++
+					}
+				}
+				j++
+			}
+			if j == i {
+				// Skip a stray ')'.
+				i++
+				continue
+			}
+			toks = append(toks, addrToken{'a', s[i:j]})
+			i = j
+		}
+	}
+	return toks
+}
+
+// parseAddressList parses an RFC 5322 address-list into ENVELOPE address
+// structures.
+func parseAddressList(s string) []*Address {
+	toks := lexAddresses(s)
+	var out []*Address
+	for len(toks) > 0 {
+		var words []string
+		i := 0
+		for i < len(toks) && (toks[i].kind == 'a' || toks[i].kind == 'q') {
+			words = append(words, toks[i].s)
+			i++
+		}
+		next := byte(0)
+		if i < len(toks) {
+			next = toks[i].kind
+		}
+		switch next {
+		case ':':
+			out = append(out, &Address{Mailbox: strings.Join(words, " ")})
+			toks = toks[i+1:]
+			continue
+		case '<':
+			j := i + 1
+			for j < len(toks) && toks[j].kind != '>' {
+				j++
+			}
+			a := parseAddrSpec(toks[i+1 : j])
+			a.Name = strings.Join(words, " ")
+			out = append(out, a)
+			i = j
+		case '@':
+			j := i
+			for j < len(toks) && toks[j].kind != ',' && toks[j].kind != ';' {
+				j++
+			}
+			out = append(out, parseAddrSpec(toks[:j]))
+			i = j
+		default:
+			if len(words) > 0 {
+				out = append(out, &Address{Mailbox: strings.Join(words, "")})
+			}
+		}
+		for i < len(toks) && toks[i].kind != ',' && toks[i].kind != ';' {
+			i++
+		}
+		if i < len(toks) && toks[i].kind == ';' {
+			out = append(out, &Address{})
+		}
+		if i < len(toks) {
+			i++
+		}
+		toks = toks[i:]
+	}
+	return out
+}
+
+// parseAddrSpec parses [route ":"] local-part "@" domain.
+func parseAddrSpec(toks []addrToken) *Address {
+	a := &Address{}
+	if len(toks) > 0 && toks[0].kind == '@' {
+		var route strings.Builder
+		i := 0
+		for ; i < len(toks) && toks[i].kind != ':'; i++ {
+			if toks[i].kind == 'a' {
+				route.WriteString(toks[i].s)
+			} else {
+				route.WriteByte(toks[i].kind)
+			}
+		}
+		a.Route = route.String()
+		if i < len(toks) {
+			i++
+		}
+		toks = toks[i:]
+	}
+	var local, host strings.Builder
+	atHost := false
+	for _, t := range toks {
+		switch {
+		case t.kind == '@':
+			atHost = true
+		case t.kind != 'a' && t.kind != 'q':
+		case atHost:
+			host.WriteString(t.s)
+		default:
+			local.WriteString(t.s)
+		}
+	}
+	a.Mailbox = local.String()
+	a.Host = host.String()
+	return a
+}
@@ -0,0 +1,60 @@
+package imapd
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseAddressList(t *testing.T) {
+	tests := []struct {
+		list string
+		exp  []*Address
+	}{
+		{"joe@example.com", []*Address{{Mailbox: "joe", Host: "example.com"}}},
+		{`"Doe, John" <john.doe@example.com>, =?UTF-8?Q?Jos=C3=A9?= <jose@example.com> (comment)`, []*Address{
+			{Name: "Doe, John", Mailbox: "john.doe", Host: "example.com"},
+			{Name: "=?UTF-8?Q?Jos=C3=A9?=", Mailbox: "jose", Host: "example.com"},
+		}},
+		{"Friends: ann@example.com, Bob <bob@[192.0.2.1]>;, carl@example.com", []*Address{
+			{Mailbox: "Friends"},
+			{Mailbox: "ann", Host: "example.com"},
+			{Name: "Bob", Mailbox: "bob", Host: "[192.0.2.1]"},
+			{},
+			{Mailbox: "carl", Host: "example.com"},
+		}},
+		{"undisclosed-recipients:;", []*Address{{Mailbox: "undisclosed-recipients"}, {}}},
+		{"Relay <@a.example,@b.example:user@c.example>", []*Address{{Name: "Relay", Route: "@a.example,@b.example", Mailbox: "user", Host: "c.example"}}},
+		{"", nil},
+	}
+	for _, test := range tests {
+		if addrs := parseAddressList(test.list); !reflect.DeepEqual(addrs, test.exp) {
+			t.Fatalf("parseAddressList(%q) returned %+v expected %+v", test.list, addrs, test.exp)
+		}
+	}
+}
+
+func TestParseEnvelope(t *testing.T) {
+	// Example from RFC 3501 section 8
+	msg := "Date: Wed, 17 Jul 1996 02:23:25 -0700 (PDT)\r\n" +
+		"From: Terry Gray <gray@cac.washington.edu>\r\n" +
+		"Subject: IMAP4rev1 WG mtg summary and minutes\r\n" +
+		"To: imap@cac.washington.edu\r\n" +
+		"cc: minutes@CNRI.Reston.VA.US,\r\n John Klensin <KLENSIN@MIT.EDU>\r\n" +
+		"Message-Id: <B27397-0100000@cac.washington.edu>\r\n" +
+		"\r\n" +
+		"Body\r\n"
+	exp := `("Wed, 17 Jul 1996 02:23:25 -0700 (PDT)" "IMAP4rev1 WG mtg summary and minutes" ` +
+		`(("Terry Gray" NIL "gray" "cac.washington.edu")) (("Terry Gray" NIL "gray" "cac.washington.edu")) ` +
+		`(("Terry Gray" NIL "gray" "cac.washington.edu")) ((NIL NIL "imap" "cac.washington.edu")) ` +
+		`((NIL NIL "minutes" "CNRI.Reston.VA.US")("John Klensin" NIL "KLENSIN" "MIT.EDU")) NIL NIL ` +
+		`"<B27397-0100000@cac.washington.edu>")`
+	if env := ParseEnvelope([]byte(msg)).String(); env != exp {
+		t.Fatalf("ParseEnvelope returned\n%s\nexpected\n%s", env, exp)
+	}
+
+	env := ParseEnvelope([]byte("Subject: Caf\xc3\xa9\r\n\r\n")).String()
+	exp = "(NIL {5}\r\nCaf\xc3\xa9 NIL NIL NIL NIL NIL NIL NIL NIL)"
+	if env != exp {
+		t.Fatalf("ParseEnvelope returned %q expected %q", env, exp)
+	}
+}
@@ -6,18 +6,24 @@ package imapd
 import (
 	"bufio"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
 const (
-	defaultPort    = 143
-	defaultSSLPort = 993
+	defaultPort           = 143
+	defaultSSLPort        = 993
+	defaultMaxMessageSize = 64 << 20
+	defaultPollInterval   = 30 * time.Second
 )
 
 // 2.3.2.  Flags Message Attribute
@@ -49,36 +55,51 @@ const (
 	internalDateFormat = "02-Jan-2006 15:04:05 -0700"
 )
 
-var (
-	envelopeFields = []string{
-		"Date",
-		"Subject",
-		"From", // personal name, SMTP at-domain-list (source route), mailbox name, host name
-		"Sender",
-		"Reply-To",
-		"To",
-		"CC",
-		"BCC",
-		"In-Reply-To",
-		"Message-Id",
-	}
-)
-
 type Server struct {
 	Addr         string        // TCP address to listen on, ":143" if empty
 	ReadTimeout  time.Duration // optional read timeout
 	WriteTimeout time.Duration // optional write timeout
 
+	// PollInterval is how often a selected mailbox that isn't a Notifier
+	// is listed during IDLE, 30 seconds if 0.
+	PollInterval time.Duration
+
+	MaxMessageSize int64 // maximum size of an appended message, 64MB if 0
+
+	// Debug optionally receives a trace of the names of commands and of
+	// the responses, which include message contents.
+	Debug io.Writer
+
 	TlsConfig     *tls.Config
 	InsecureLogin bool // allow login even when connection isn't secure
 
-	Backend Backend
+	// SASL mechanisms offered by AUTHENTICATE keyed by upper case
+	// name. DefaultSASLMechanisms is used if nil.
+	SASLMechanisms map[string]*SASLMechanism
+	// ValidateToken optionally validates an OAuth 2.0 bearer token sent
+	// with the OAUTHBEARER or XOAUTH2 mechanisms. The username is the
+	// authorization identity given by the client, which may be empty.
+	// It returns the name of the user to pass to the Backend's
+	// LookupUser, or an error which can be an *OAuthError.
+	ValidateToken func(username, token string) (string, error)
+	// MapCertificate optionally maps a verified TLS client certificate
+	// to a user for the EXTERNAL mechanism. The authzid is the
+	// authorization identity requested by the client, which may be
+	// empty. It returns the name of the user to pass to the Backend's
+	// LookupUser.
+	MapCertificate func(cert *x509.Certificate, authzid string) (string, error)
+
+	Backend Backend // should implement Authenticator to allow users to log in
 }
 
 // Connection is implemented by the IMAP library and provided to callers
 // customizing their own Servers.
 type Connection interface {
 	Addr() net.Addr
+	Server() *Server
+	// TLSConnectionState returns the state of the TLS connection and
+	// false if the connection does not use TLS.
+	TLSConnectionState() (tls.ConnectionState, bool)
 }
 
 // ListenAndServe listens on the TCP network address srv.Addr and then
@@ -128,17 +149,42 @@ func (srv *Server) Serve(ln net.Listener, secure bool) error {
 		sess.secure = secure
 		go sess.serve()
 	}
-	panic("not reached")
 }
 
 type session struct {
-	srv           *Server
-	rwc           net.Conn
-	br            *bufio.Reader
-	bw            *bufio.Writer
-	secure        bool
-	authenticated bool
-	mailbox       Mailbox
+	srv      *Server
+	rwc      net.Conn
+	br       *bufio.Reader
+	bw       *bufio.Writer
+	p        *parser
+	secure   bool
+	state    sessionState
+	user     string
+	backend  Backend  // backend for the authenticated user
+	mailbox  Mailbox  // selected mailbox
+	name     string   // name of the selected mailbox
+	readOnly bool     // selected with EXAMINE or the mailbox is read-only
+	uids     []uint32 // UIDs of the selected mailbox in sequence number order
+	recent   uint32   // number of recent messages last sent to the client
+
+	stopWatch func()          // stops the Notifier of the selected mailbox
+	updateMu  sync.Mutex      // protects updates
+	updates   []MailboxUpdate // changes reported by the Notifier not yet sent
+	updated   chan struct{}   // signaled when an update is added
+}
+
+func (srv *Server) maxMessageSize() int64 {
+	if srv.MaxMessageSize > 0 {
+		return srv.MaxMessageSize
+	}
+	return defaultMaxMessageSize
+}
+
+func (srv *Server) pollInterval() time.Duration {
+	if srv.PollInterval > 0 {
+		return srv.PollInterval
+	}
+	return defaultPollInterval
 }
 
 func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
@@ -147,7 +193,11 @@ func (srv *Server) newSession(rwc net.Conn) (s *session, err error) {
 		rwc: rwc,
 		br:  bufio.NewReader(rwc),
 		bw:  bufio.NewWriter(rwc),
+
+		state:   stateNotAuthenticated,
+		updated: make(chan struct{}, 1),
 	}
+	s.p = &parser{br: s.br, cont: s.continuation}
 	return
 }
 
@@ -159,7 +209,9 @@ func (s *session) sendf(format string, args ...interface{}) error {
 	if s.srv.WriteTimeout != 0 {
 		s.rwc.SetWriteDeadline(time.Now().Add(s.srv.WriteTimeout))
 	}
-	fmt.Printf("> '"+format+"'\n", args...)
+	if s.srv.Debug != nil {
+		fmt.Fprintf(s.srv.Debug, "> '"+format+"'\n", args...)
+	}
 	if _, err := fmt.Fprintf(s.bw, format, args...); err != nil {
 		return err
 	}
@@ -170,234 +222,163 @@ func (s *session) sendlinef(format string, args ...interface{}) error {
 	return s.sendf(format+"\r\n", args...)
 }
 
-func (s *session) sendobject(obj interface{}) error {
-	switch t := obj.(type) {
-	case nil:
-		s.sendf("NIL")
-	case int:
-		s.sendf("%d", t)
-	case string:
-		s.sendf(`"%s"`, strings.Replace(t, `"`, `\"`, -1))
-	case []string:
-		s.sendf("(%s)", strings.Join(t, " "))
-	case time.Time:
-		s.sendf(`"` + t.Format(internalDateFormat) + `"`)
-	case []byte:
-		if err := s.sendf("{%d}\r\n", len(t)); err != nil {
+func (s *session) Addr() net.Addr {
+	return s.rwc.RemoteAddr()
+}
+
+func (s *session) Server() *Server {
+	return s.srv
+}
+
+func (s *session) TLSConnectionState() (tls.ConnectionState, bool) {
+	if c, ok := s.rwc.(*tls.Conn); ok {
+		return c.ConnectionState(), true
+	}
+	return tls.ConnectionState{}, false
+}
+
+// login verifies the user's credentials with the Backend's Authenticator.
+func (srv *Server) login(username, password string) (Backend, error) {
+	auth, ok := srv.Backend.(Authenticator)
+	if !ok {
+		log.Printf("imapd: Backend does not implement Authenticator")
+		return nil, ErrAuthenticationFailed
+	}
+	return auth.Login(username, password)
+}
+
+func (s *session) setUser(username string, backend Backend) {
+	s.state = stateAuthenticated
+	s.p.maxAppend = s.srv.maxMessageSize()
+	s.user = username
+	s.backend = backend
+}
+
+func (s *session) capabilities() []string {
+	// LITERAL+ NAMESPACE MAILBOX-REFERRALS BINARY UNSELECT SCAN SORT THREAD=REFERENCES
+	// THREAD=ORDEREDSUBJECT MULTIAPPEND LOGIN-REFERRALS
+	caps := []string{"IMAP4rev1", "SASL-IR", "IDLE", "APPENDLIMIT=" + strconv.FormatInt(s.srv.maxMessageSize(), 10)}
+	if s.srv.TlsConfig != nil && !s.secure {
+		caps = append(caps, "STARTTLS")
+	}
+	for _, name := range s.saslMechanisms() {
+		caps = append(caps, "AUTH="+name)
+	}
+	if !s.secure && !s.srv.InsecureLogin {
+		caps = append(caps, "LOGINDISABLED")
+	}
+	return caps
+}
+
+// authenticate runs a SASL exchange with the client (6.2.2).
+func (s *session) authenticate(m *SASLMechanism, initial []byte) error {
+	sasl := m.New(s)
+	response := initial
+	for {
+		challenge, done, err := sasl.Next(response)
+		if err != nil {
 			return err
 		}
-		if _, err := s.bw.Write(t); err != nil {
+		if done && challenge == nil {
+			s.setUser(sasl.User())
+			return nil
+		}
+		s.sendlinef("+ %s", base64.StdEncoding.EncodeToString(challenge))
+		line, err := s.p.readLine()
+		if err != nil {
 			return err
 		}
+		if line == "*" {
+			return errAuthenticationCancelled
+		}
+		if response, err = base64.StdEncoding.DecodeString(line); err != nil {
+			return syntaxError("invalid base64 response")
+		}
+		if done {
+			if len(response) != 0 {
+				return ErrAuthenticationFailed
+			}
+			s.setUser(sasl.User())
+			return nil
+		}
 	}
-	return errors.New("imapd: unknown type in sendobject")
 }
 
-func (s *session) Addr() net.Addr {
-	return s.rwc.RemoteAddr()
+// sendLoginResult sends the tagged response for a LOGIN or AUTHENTICATE
+// command that completed with err.
+func (s *session) sendLoginResult(tag string, err error) {
+	if _, ok := err.(syntaxError); ok {
+		s.sendlinef("%s BAD %s", tag, err.Error())
+		return
+	}
+	switch err {
+	case nil:
+		s.sendlinef("%s OK User logged in", tag)
+	case errAuthenticationCancelled:
+		s.sendlinef("%s BAD Authentication cancelled", tag)
+	case ErrAuthenticationFailed:
+		s.sendlinef("%s NO [AUTHENTICATIONFAILED] Authentication failed", tag)
+	default:
+		s.errorf("Error authenticating user: %+v", err)
+		s.sendlinef("%s NO [UNAVAILABLE] internal error", tag)
+	}
+}
+
+func (s *session) continuation() error {
+	return s.sendlinef("+ Ready for literal data")
 }
 
 func (s *session) serve() {
 	defer s.rwc.Close()
-	s.sendlinef("* OK [CAPABILITY IMAP4rev1 AUTH=LOGIN] hostname.com IMAP4rev1 2004.350 at Sun, 8 Aug 2004 13:51:21 -0500 (CDT)")
-	for {
+	defer s.unselect()
+	// The capabilities in the greeting depend on the client certificate,
+	// which is only known after the handshake.
+	if c, ok := s.rwc.(*tls.Conn); ok {
 		if s.srv.ReadTimeout != 0 {
 			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
 		}
-		sl, err := s.br.ReadSlice('\n')
-		if err != nil {
-			s.errorf("read error: %v", err)
-			return
-		}
-
-		fmt.Printf("< %s", sl)
-
-		parts := strings.Split(strings.TrimSpace(string(sl)), " ")
-		if len(parts) < 2 {
-			s.errorf("too short command %s", sl)
+		if err := c.Handshake(); err != nil {
+			s.errorf("TLS handshake error: %v", err)
 			return
 		}
-		tag, cmd := parts[0], strings.ToLower(parts[1])
-		args := []string{}
-		if len(parts) > 2 {
-			args = parts[2:]
+	}
+	s.sendlinef("* OK [CAPABILITY %s] IMAP4rev1 Service Ready", strings.Join(s.capabilities(), " "))
+	for {
+		if s.srv.ReadTimeout != 0 {
+			s.rwc.SetReadDeadline(time.Now().Add(s.srv.ReadTimeout))
 		}
-
-		switch cmd {
-		case "noop":
-			// TODO: Send any status updates as untagged responses
-			s.sendlinef("%s OK NOOP completed", tag)
-		case "capability":
-			// LITERAL+ IDLE NAMESPACE MAILBOX-REFERRALS BINARY UNSELECT SCAN SORT THREAD=REFERENCES
-			// THREAD=ORDEREDSUBJECT MULTIAPPEND SASL-IR LOGIN-REFERRALS AUTH=LOGIN
-			caps := []string{"IMAP4rev1"}
-			if s.srv.TlsConfig != nil {
-				caps = append(caps, "STARTTLS")
-			}
-			if s.secure || s.srv.InsecureLogin {
-				caps = append(caps, "AUTH=login")
-			} else {
-				caps = append(caps, "LOGINDISABLED")
-			}
-			s.sendlinef("* CAPABILITY " + strings.Join(caps, " "))
-			s.sendlinef("%s OK CAPABILITY completed", tag)
-		case "starttls":
-			if s.secure {
-				s.sendlinef("%s NO connection already secure", tag)
-			} else if s.srv.TlsConfig == nil {
-				s.sendlinef("%s NO TLS not configured", tag)
-			} else {
-				s.sendlinef("%s OK Begin TLS negotiation now")
-				s.bw.Flush()
-				c := tls.Server(s.rwc, s.srv.TlsConfig)
-				if err := c.Handshake(); err != nil {
-					s.errorf("TLS handshake failed: %+v", err)
-					return
-				}
-				s.rwc = c
-				s.br = bufio.NewReader(c)
-				s.bw = bufio.NewWriter(c)
-				s.secure = true
-			}
-		// case "authenticate": // 6.2.2
-		case "login": // "username" password
-			if s.secure || s.srv.InsecureLogin {
-				// TODO
-				s.authenticated = true
-				s.sendlinef("%s OK User logged in", tag)
-			} else {
-				s.sendlinef("%s NO Login only supported over a secure connection", tag)
-			}
-		case "close":
-			s.sendlinef("%s OK Returned to authenticated state. (Success)", tag)
-		case "logout":
-			s.sendlinef("* BYE LOGOUT Requested")
-			s.sendlinef("%s OK %d good day (Success)", tag, 0)
-		case "status": // 6.3.10 - STATUS [mailbox name] ([status data item names])
-			if len(args) < 2 {
-				s.sendlinef("%s BAD Missing mailbox and item names", tag)
-			} else {
-				mb, err := s.srv.Backend.Mailbox(args[0])
-				if err != nil {
-					if err == ErrUnknownMailbox {
-						s.sendlinef("%s NO unknown mailbox", tag)
-					} else {
-						s.errorf("Error selecting mailbox %s: %+v", args[0], err)
-						s.sendlinef("%s NO internal error", tag)
-					}
-				} else {
-					info, err := mb.Info()
-					if err != nil {
-						s.errorf("Error getting info for mailbox %s: %+v", args[0], err)
-						s.sendlinef("%s NO internal error", tag)
-					} else {
-						s.sendf("* STATUS %s (", args[0])
-						for i, it := range strings.Split(args[1][1:len(args[1])-1], " ") {
-							if i != 0 {
-								s.sendf(" ")
-							}
-							switch strings.ToUpper(it) {
-							case "MESSAGES":
-								s.sendf("MESSAGES %d", info.Exists)
-							case "RECENT":
-								s.sendf("RECENT %d", info.Recent)
-							case "UIDNEXT":
-								s.sendf("UIDNEXT %d", info.NextUid)
-							case "UIDVALIDITY":
-								s.sendf("UIDVALIDITY %d", info.UidValidity)
-							case "UNSEEN":
-								// Number of messages which do not have the \Seen flag set.
-								s.sendf("UNSEEN %d", info.Unseen)
-							}
-						}
-						s.sendlinef(")")
-					}
-				}
-			}
-		case "select": // 6.3.1 - SELECT [mailbox name]
-			if len(args) < 1 {
-				s.sendlinef("%s BAD Missing mailbox name", tag)
-			} else {
-				s.mailbox, err = s.srv.Backend.Mailbox(args[0])
-				if err != nil {
-					if err == ErrUnknownMailbox {
-						s.sendlinef("%s NO unknown mailbox", tag)
-					} else {
-						s.errorf("Error selecting mailbox %s: %+v", args[0], err)
-						s.sendlinef("%s NO internal error", tag)
-					}
-				} else {
-					info, err := s.mailbox.Info()
-					if err != nil {
-						s.errorf("Error getting info for mailbox %s: %+v", args[0], err)
-						s.sendlinef("%s NO internal error", tag)
-					} else {
-						s.sendlinef(`* FLAGS (\Answered \Flagged \Draft \Deleted \Seen)`)
-						s.sendlinef(`* OK [PERMANENTFLAGS (\Answered \Flagged \Draft \Deleted \Seen \*)]`)
-						s.sendlinef(`* OK [UIDVALIDITY %d]`, info.UidValidity)
-						s.sendlinef(`* OK [UIDNEXT %d]`, info.NextUid)
-						// s.sendlinef("* OK [UNSEEN %d]", ...) // The message sequence number of the first unseen message in the mailbox.
-						s.sendlinef("* %d EXISTS", info.Exists)
-						s.sendlinef("* %d RECENT", info.Recent)
-						s.sendlinef("%s OK [READ-WRITE] Completed", tag)
-					}
-				}
+		tag, cmd, args, err := s.p.readCommand()
+		if err != nil {
+			if _, ok := err.(syntaxError); !ok {
+				s.errorf("read error: %v", err)
+				return
 			}
-		// case "namespace":
-		case "list": // 6.3.8: LIST [reference name] [mailbox name with possible wildcards]
-			if args[1] == "" {
-				s.sendlinef(`* LIST (\Noselect) "/" "/"`)
-			} else { // "/"
-				s.sendlinef(`* LIST (\HasNoChildren) "/" "INBOX"`)
+			if tag == "" {
+				tag = "*"
 			}
-			s.sendlinef("%s OK LIST complete", tag)
-		// case "fetch": // message-set (...)
-		// * 1 FETCH (UID 1517)
-		// %s OK Success
-		case "uid":
-			if len(args) < 1 {
-				s.sendlinef("%s BAD Missing command", tag)
+			s.errorf("%v", err)
+			if err == errTooBig {
+				s.sendlinef("%s NO [TOOBIG] Literal exceeds the maximum message size", tag)
 			} else {
-				cmd = strings.ToLower(args[0])
-				args = args[1:]
-				switch cmd {
-				case "fetch": // UID FETCH [uid set] [message data item names or macro]
-					// TODO: Check len(args) >= 2
-					rangeSet := parseRangeSet(args[0])
-					itemNames, err := parseMessageDataItemNames(strings.Join(args[1:], " "))
-					if err != nil {
-						s.errorf("Error item names %s: %+v", args[0], err)
-						s.sendlinef("%s BAD invalid item names", tag)
-					} else if rangeSet == nil {
-						s.errorf("Error parsing range set %s", args[0])
-						s.sendlinef("%s BAD invalid range", tag)
-					} else {
-						items, err := s.mailbox.FetchMessagesByUID(rangeSet, itemNames)
-						if err != nil {
-							s.errorf("Error fetching by UID %s %s: %+v", args[0], args[1], err)
-							s.sendlinef("%s BAD internal error", tag)
-						} else {
-							for seqNum, data := range items {
-								s.sendf("* %d FETCH (", seqNum)
-								for i, v := range data {
-									if i == 0 {
-										s.sendf("%s ", v.Item.String())
-									} else {
-										s.sendf(" %s ", v.Item.String())
-									}
-									s.sendobject(v.Data)
-								}
-								s.sendlinef(")")
-							}
-							s.sendlinef("%s OK Success", tag)
-						}
-					}
-				default:
-					s.sendlinef("%s BAD Unknown command", tag)
-				}
+				s.sendlinef("%s BAD %s", tag, err.Error())
 			}
-		default:
-			s.sendlinef("%s BAD Unknown command", tag)
+			continue
+		}
+
+		// Arguments aren't traced since they include passwords.
+		if s.srv.Debug != nil {
+			fmt.Fprintf(s.srv.Debug, "< %s %s\n", tag, cmd)
+		}
+
+		// Changes of the selected mailbox can be sent once a command is in
+		// progress. Sending them before running the command keeps sequence
+		// numbers in responses consistent with the ones in the arguments.
+		if err := s.sendUpdates(!holdExpunge[cmd]); err != nil {
+			s.errorf("Error sending updates: %+v", err)
+		}
+		s.dispatch(commands, tag, cmd, args)
+		if s.state == stateLogout {
+			return
 		}
 	}
 }
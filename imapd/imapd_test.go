@@ -0,0 +1,1035 @@
+package imapd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testBackend struct {
+	users         map[string]string
+	mailboxes     []*MailboxResponse
+	boxes         map[string]*testMailbox
+	subscriptions []string
+	polling       bool // mailboxes aren't Notifiers
+}
+
+// appendOnlyMailbox is a testMailbox that can't store flags or expunge.
+type appendOnlyMailbox struct {
+	Mailbox
+	Appender
+}
+
+// pollingMailbox is a testMailbox that isn't a Notifier.
+type pollingMailbox struct {
+	Mailbox
+	UIDLister
+}
+
+type testMessage struct {
+	uid   uint32
+	flags []string
+	date  time.Time
+	body  []byte
+}
+
+type testMailbox struct {
+	nextUID       uint32
+	messages      []*testMessage
+	readOnly      bool
+	recentCleared bool
+	notify        func(MailboxUpdate) // set while watched
+	afterInfo     func()              // called once after Info
+	mu            sync.Mutex          // guards messages changed during IDLE
+	maxMessages   int                 // Append fails beyond this many messages if > 0
+	appendOnly    bool
+}
+
+func (mb *testMailbox) Info() (MailboxInfo, error) {
+	mb.mu.Lock()
+	info := MailboxInfo{NextUid: mb.nextUID, UidValidity: 1, Exists: uint32(len(mb.messages)), ReadOnly: mb.readOnly}
+	for _, msg := range mb.messages {
+		seen := false
+		for _, f := range msg.flags {
+			seen = seen || f == FlagSeen
+		}
+		if !seen {
+			info.Unseen++
+		}
+	}
+	mb.mu.Unlock()
+	if f := mb.afterInfo; f != nil {
+		mb.afterInfo = nil
+		f()
+	}
+	return info, nil
+}
+
+func (mb *testMailbox) FetchMessages(ranges []Range, items []MessageDataItemName, fn FetchFunc) error {
+	for _, msg := range mb.messages {
+		for _, r := range ranges {
+			if !r.Contains(msg.uid) {
+				continue
+			}
+			data := []MessageDataItem{}
+			for _, it := range items {
+				switch it.Name {
+				case "UID":
+					data = append(data, MessageDataItem{it, int(msg.uid)})
+				case "FLAGS":
+					data = append(data, MessageDataItem{it, msg.flags})
+				case "INTERNALDATE":
+					data = append(data, MessageDataItem{it, msg.date})
+				case "RFC822.SIZE":
+					data = append(data, MessageDataItem{it, len(msg.body)})
+				case "ENVELOPE":
+					data = append(data, MessageDataItem{it, ParseEnvelope(msg.body)})
+				case "BODY", "BODYSTRUCTURE":
+					data = append(data, MessageDataItem{it, ParseBodyStructure(msg.body)})
+				case "BODY[]", "BODY.PEEK[]", "RFC822", "RFC822.HEADER", "RFC822.TEXT":
+					data = append(data, MessageDataItem{it, BodySection(msg.body, it)})
+				}
+			}
+			if err := fn(msg.uid, data); err != nil {
+				return err
+			}
+			break
+		}
+	}
+	return nil
+}
+
+func (mb *testMailbox) UIDs() ([]uint32, error) {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	uids := make([]uint32, len(mb.messages))
+	for i, msg := range mb.messages {
+		uids[i] = msg.uid
+	}
+	return uids, nil
+}
+
+func (mb *testMailbox) StoreFlags(uids []Range, mode StoreMode, flags []string) ([]MessageFlags, error) {
+	res := []MessageFlags{}
+	for _, msg := range mb.messages {
+		for _, r := range uids {
+			if !r.Contains(msg.uid) {
+				continue
+			}
+			newFlags := []string{}
+			if mode != StoreReplace {
+				for _, f := range msg.flags {
+					if !containsFlag(flags, f) {
+						newFlags = append(newFlags, f)
+					}
+				}
+			}
+			if mode != StoreRemove {
+				newFlags = append(newFlags, flags...)
+			}
+			msg.flags = newFlags
+			res = append(res, MessageFlags{UID: msg.uid, Flags: msg.flags})
+			break
+		}
+	}
+	return res, nil
+}
+
+func containsFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if f == flag {
+			return true
+		}
+	}
+	return false
+}
+
+func (mb *testMailbox) Expunge() ([]uint32, error) {
+	uids := []uint32{}
+	messages := mb.messages[:0]
+	for _, msg := range mb.messages {
+		if containsFlag(msg.flags, FlagDeleted) {
+			uids = append(uids, msg.uid)
+		} else {
+			messages = append(messages, msg)
+		}
+	}
+	mb.messages = messages
+	return uids, nil
+}
+
+func (mb *testMailbox) Watch(fn func(MailboxUpdate)) func() {
+	mb.notify = fn
+	return func() { mb.notify = nil }
+}
+
+func (mb *testMailbox) ClearRecent() error {
+	mb.recentCleared = true
+	return nil
+}
+
+func (mb *testMailbox) Append(flags []string, date time.Time, message []byte) error {
+	mb.mu.Lock()
+	defer mb.mu.Unlock()
+	if mb.maxMessages > 0 && len(mb.messages) >= mb.maxMessages {
+		return errors.New("mailbox full")
+	}
+	mb.messages = append(mb.messages, &testMessage{uid: mb.nextUID, flags: flags, date: date, body: message})
+	mb.nextUID++
+	return nil
+}
+
+func newTestBackend() *testBackend {
+	return &testBackend{
+		users: map[string]string{"user": "pass"},
+		mailboxes: []*MailboxResponse{
+			{Name: "INBOX", Delimiter: "/"},
+			{Name: "Sent Items", Delimiter: "/", Marked: true},
+			{Name: "Archive/2012", Delimiter: "/", Noinferiors: true},
+		},
+		boxes: map[string]*testMailbox{
+			"INBOX": {nextUID: 1},
+		},
+	}
+}
+
+func (b *testBackend) find(name string) int {
+	for i, mb := range b.mailboxes {
+		if mb.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func (b *testBackend) Login(username, password string) (Backend, error) {
+	if pw, ok := b.users[username]; !ok || pw != password {
+		return nil, ErrAuthenticationFailed
+	}
+	return b, nil
+}
+
+func (b *testBackend) ListMailboxes() ([]*MailboxResponse, error) {
+	return b.mailboxes, nil
+}
+
+func (b *testBackend) Subscriptions() ([]string, error) {
+	return b.subscriptions, nil
+}
+
+func (b *testBackend) Subscribe(name string) error {
+	b.subscriptions = append(b.subscriptions, name)
+	return nil
+}
+
+func (b *testBackend) Unsubscribe(name string) error {
+	for i, n := range b.subscriptions {
+		if n == name {
+			b.subscriptions = append(b.subscriptions[:i], b.subscriptions[i+1:]...)
+			return nil
+		}
+	}
+	return ErrUnknownMailbox
+}
+
+func (b *testBackend) CreateMailbox(name string) error {
+	if b.find(name) >= 0 {
+		return ErrMailboxExists
+	}
+	b.mailboxes = append(b.mailboxes, &MailboxResponse{Name: name, Delimiter: "/"})
+	return nil
+}
+
+func (b *testBackend) DeleteMailbox(name string) error {
+	i := b.find(name)
+	if i < 0 {
+		return ErrUnknownMailbox
+	}
+	b.mailboxes = append(b.mailboxes[:i], b.mailboxes[i+1:]...)
+	return nil
+}
+
+func (b *testBackend) RenameMailbox(oldName, newName string) error {
+	i := b.find(oldName)
+	if i < 0 {
+		return ErrUnknownMailbox
+	} else if b.find(newName) >= 0 {
+		return ErrMailboxExists
+	}
+	if oldName == "INBOX" {
+		return b.CreateMailbox(newName)
+	}
+	b.mailboxes[i].Name = newName
+	return nil
+}
+
+func (b *testBackend) Mailbox(name string) (Mailbox, error) {
+	if strings.EqualFold(name, "INBOX") {
+		name = "INBOX"
+	}
+	if mb := b.boxes[name]; mb != nil && mb.appendOnly {
+		return appendOnlyMailbox{mb, mb}, nil
+	} else if mb != nil && b.polling {
+		return pollingMailbox{mb, mb}, nil
+	} else if mb != nil {
+		return mb, nil
+	}
+	return nil, ErrUnknownMailbox
+}
+
+type testConn struct {
+	t  *testing.T
+	c  net.Conn
+	br *bufio.Reader
+}
+
+func newTestConn(t *testing.T, srv *Server) *testConn {
+	if srv.Backend == nil {
+		srv.Backend = newTestBackend()
+	}
+	client, server := net.Pipe()
+	s, _ := srv.newSession(server)
+	go s.serve()
+	c := &testConn{t: t, c: client, br: bufio.NewReader(client)}
+	if line := c.readLine(); !strings.HasPrefix(line, "* OK ") {
+		t.Fatalf("expected greeting, got %q", line)
+	}
+	return c
+}
+
+func (c *testConn) readLine() string {
+	line, err := c.br.ReadString('\n')
+	if err != nil {
+		c.t.Fatalf("read failed: %+v", err)
+	}
+	return strings.TrimRight(line, "\r\n")
+}
+
+func (c *testConn) send(line string) {
+	if _, err := c.c.Write([]byte(line + "\r\n")); err != nil {
+		c.t.Fatalf("write failed: %+v", err)
+	}
+}
+
+// cmd sends a tagged command and returns the untagged responses and the
+// tagged completion response or continuation request.
+func (c *testConn) cmd(tag, command string) ([]string, string) {
+	c.send(tag + " " + command)
+	return c.response(tag)
+}
+
+// response reads responses up to the tagged completion response or a
+// continuation request.
+func (c *testConn) response(tag string) ([]string, string) {
+	var untagged []string
+	for {
+		line := c.readLine()
+		if strings.HasPrefix(line, tag+" ") || strings.HasPrefix(line, "+ ") {
+			return untagged, line
+		}
+		untagged = append(untagged, line)
+	}
+}
+
+// cont sends a line in response to a continuation request.
+func (c *testConn) cont(tag, line string) ([]string, string) {
+	c.send(line)
+	return c.response(tag)
+}
+
+func TestLogin(t *testing.T) {
+	c := newTestConn(t, &Server{})
+	if _, res := c.cmd("a1", "LOGIN user pass"); !strings.HasPrefix(res, "a1 NO ") {
+		t.Fatalf("expected LOGIN to be refused on an insecure connection, got %q", res)
+	}
+
+	c = newTestConn(t, &Server{InsecureLogin: true})
+	if _, res := c.cmd("a1", "SELECT INBOX"); res != "a1 BAD Not authenticated" {
+		t.Fatalf("expected SELECT to be refused before login, got %q", res)
+	}
+	if _, res := c.cmd("a2", "LOGIN user wrong"); res != "a2 NO [AUTHENTICATIONFAILED] Authentication failed" {
+		t.Fatalf("expected authentication failure, got %q", res)
+	}
+	if _, res := c.cmd("a3", `LOGIN "user" {4}`); res != "+ Ready for literal data" {
+		t.Fatalf("expected continuation request, got %q", res)
+	}
+	if _, res := c.cont("a3", "pass"); !strings.HasPrefix(res, "a3 OK ") {
+		t.Fatalf("expected successful login, got %q", res)
+	}
+}
+
+func TestAuthenticatePlain(t *testing.T) {
+	c := newTestConn(t, &Server{InsecureLogin: true})
+	if untagged, _ := c.cmd("a1", "CAPABILITY"); len(untagged) != 1 || !strings.Contains(untagged[0], " AUTH=PLAIN") {
+		t.Fatalf("expected AUTH=PLAIN capability, got %q", untagged)
+	}
+	// \x00user\x00wrong
+	if _, res := c.cmd("a2", "AUTHENTICATE PLAIN AHVzZXIAd3Jvbmc="); !strings.HasPrefix(res, "a2 NO [AUTHENTICATIONFAILED]") {
+		t.Fatalf("expected authentication failure, got %q", res)
+	}
+	if _, res := c.cmd("a3", "AUTHENTICATE PLAIN"); res != "+ " {
+		t.Fatalf("expected empty challenge, got %q", res)
+	}
+	if _, res := c.cont("a3", "*"); res != "a3 BAD Authentication cancelled" {
+		t.Fatalf("expected cancelled authentication, got %q", res)
+	}
+	if _, res := c.cmd("a4", "AUTHENTICATE PLAIN"); res != "+ " {
+		t.Fatalf("expected empty challenge, got %q", res)
+	}
+	// \x00user\x00pass
+	if _, res := c.cont("a4", "AHVzZXIAcGFzcw=="); !strings.HasPrefix(res, "a4 OK ") {
+		t.Fatalf("expected successful authentication, got %q", res)
+	}
+}
+
+func TestAuthenticateLogin(t *testing.T) {
+	c := newTestConn(t, &Server{})
+	if _, res := c.cmd("a1", "AUTHENTICATE LOGIN"); !strings.HasPrefix(res, "a1 NO ") {
+		t.Fatalf("expected LOGIN mechanism to be refused on an insecure connection, got %q", res)
+	}
+
+	c = newTestConn(t, &Server{InsecureLogin: true})
+	if _, res := c.cmd("a1", "AUTHENTICATE LOGIN dXNlcg=="); res != "+ UGFzc3dvcmQ6" {
+		t.Fatalf("expected password challenge, got %q", res)
+	}
+	if _, res := c.cont("a1", "cGFzcw=="); !strings.HasPrefix(res, "a1 OK ") {
+		t.Fatalf("expected successful authentication, got %q", res)
+	}
+}
+
+func TestAuthenticateExternal(t *testing.T) {
+	serverCert := newTestCertificate(t, "localhost", x509.ExtKeyUsageServerAuth)
+	clientCert := newTestCertificate(t, "user", x509.ExtKeyUsageClientAuth)
+	pool := x509.NewCertPool()
+	pool.AddCert(clientCert.Leaf)
+	srv := &Server{
+		Backend: &challengeTestBackend{},
+		TlsConfig: &tls.Config{
+			Certificates:           []tls.Certificate{serverCert},
+			ClientAuth:             tls.VerifyClientCertIfGiven,
+			ClientCAs:              pool,
+			SessionTicketsDisabled: true,
+		},
+		MapCertificate: func(cert *x509.Certificate, authzid string) (string, error) {
+			if authzid != "" && authzid != cert.Subject.CommonName {
+				return "", ErrAuthenticationFailed
+			}
+			return cert.Subject.CommonName, nil
+		},
+	}
+	dial := func(certs []tls.Certificate) (*testConn, string) {
+		client, server := net.Pipe()
+		s, _ := srv.newSession(tls.Server(server, srv.TlsConfig))
+		go s.serve()
+		tc := tls.Client(client, &tls.Config{InsecureSkipVerify: true, Certificates: certs})
+		c := &testConn{t: t, c: tc, br: bufio.NewReader(tc)}
+		return c, c.readLine()
+	}
+
+	_, greeting := dial(nil)
+	if strings.Contains(greeting, " AUTH=EXTERNAL") {
+		t.Fatalf("expected no AUTH=EXTERNAL capability without a client certificate, got %q", greeting)
+	}
+
+	c, greeting := dial([]tls.Certificate{clientCert})
+	if !strings.Contains(greeting, " AUTH=EXTERNAL") {
+		t.Fatalf("expected AUTH=EXTERNAL capability in the greeting, got %q", greeting)
+	}
+	// authzid "other"
+	if _, res := c.cmd("a1", "AUTHENTICATE EXTERNAL b3RoZXI="); !strings.HasPrefix(res, "a1 NO [AUTHENTICATIONFAILED]") {
+		t.Fatalf("expected authentication failure for another authzid, got %q", res)
+	}
+	if _, res := c.cmd("a2", "AUTHENTICATE EXTERNAL ="); !strings.HasPrefix(res, "a2 OK ") {
+		t.Fatalf("expected successful authentication, got %q", res)
+	}
+}
+
+func TestSessionState(t *testing.T) {
+	c := newTestConn(t, &Server{InsecureLogin: true})
+	c.cmd("a1", "LOGIN user pass")
+	if _, res := c.cmd("a2", "LOGIN user pass"); res != "a2 BAD Already authenticated" {
+		t.Fatalf("expected LOGIN to be refused after login, got %q", res)
+	}
+	if _, res := c.cmd("a3", "UID FETCH 1 FLAGS"); res != "a3 BAD No mailbox selected" {
+		t.Fatalf("expected UID FETCH to be refused without a selected mailbox, got %q", res)
+	}
+	if _, res := c.cmd("a4", "CLOSE"); res != "a4 BAD No mailbox selected" {
+		t.Fatalf("expected CLOSE to be refused without a selected mailbox, got %q", res)
+	}
+	if untagged, res := c.cmd("a5", "LOGOUT"); len(untagged) != 1 || !strings.HasPrefix(untagged[0], "* BYE ") || !strings.HasPrefix(res, "a5 OK ") {
+		t.Fatalf("expected BYE and OK on LOGOUT, got %q %q", untagged, res)
+	}
+	if _, err := c.br.ReadString('\n'); err == nil {
+		t.Fatalf("expected connection to be closed after LOGOUT")
+	}
+}
+
+func TestList(t *testing.T) {
+	c := newTestConn(t, &Server{InsecureLogin: true})
+	c.cmd("a1", "LOGIN user pass")
+	tests := []struct {
+		args     string
+		untagged []string
+	}{
+		{`"" ""`, []string{`* LIST (\Noselect) "/" ""`}},
+		{`"" "*"`, []string{`* LIST () "/" "INBOX"`, `* LIST (\Marked) "/" "Sent Items"`, `* LIST (\Noinferiors) "/" "Archive/2012"`}},
+		{`"" %`, []string{`* LIST () "/" "INBOX"`, `* LIST (\Marked) "/" "Sent Items"`, `* LIST (\Noselect) "/" "Archive"`}},
+		{`Archive/ %`, []string{`* LIST (\Noinferiors) "/" "Archive/2012"`}},
+		{`"" inbox`, []string{`* LIST () "/" "INBOX"`}},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a2", "LIST "+test.args)
+		if !strings.HasPrefix(res, "a2 OK ") || !reflect.DeepEqual(untagged, test.untagged) {
+			t.Fatalf("LIST %s returned %q %q expected %q", test.args, untagged, res, test.untagged)
+		}
+	}
+}
+
+func TestMailboxManagement(t *testing.T) {
+	b := newTestBackend()
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	tests := []struct {
+		command, res string
+	}{
+		{`CREATE "Work/Projects/Go"`, "a2 OK CREATE completed"},
+		{`CREATE Work/`, "a2 NO [ALREADYEXISTS] Mailbox already exists"},
+		{`CREATE inbox`, "a2 NO [ALREADYEXISTS] Mailbox already exists"},
+		{`DELETE Missing`, "a2 NO [NONEXISTENT] Mailbox does not exist"},
+		{`DELETE Work/Projects/Go`, "a2 OK DELETE completed"},
+		{`RENAME Work Play/Old`, "a2 OK RENAME completed"},
+		{`RENAME "Sent Items" Play/Old`, "a2 NO [ALREADYEXISTS] Mailbox already exists"},
+		{`RENAME Missing New/Sub/Box`, "a2 NO [NONEXISTENT] Mailbox does not exist"},
+		{`RENAME inbox "Old Mail"`, "a2 OK RENAME completed"},
+	}
+	for _, test := range tests {
+		if _, res := c.cmd("a2", test.command); res != test.res {
+			t.Fatalf("%s returned %q expected %q", test.command, res, test.res)
+		}
+	}
+	names := []string{}
+	for _, mb := range b.mailboxes {
+		names = append(names, mb.Name)
+	}
+	exp := []string{"INBOX", "Sent Items", "Archive/2012", "Play/Old", "Work/Projects", "Play", "Old Mail"}
+	if !reflect.DeepEqual(names, exp) {
+		t.Fatalf("mailboxes are %q expected %q", names, exp)
+	}
+}
+
+func TestSubscriptions(t *testing.T) {
+	c := newTestConn(t, &Server{InsecureLogin: true})
+	c.cmd("a1", "LOGIN user pass")
+	for _, name := range []string{"inbox", "Archive/2012", "Deleted/Old"} {
+		if _, res := c.cmd("a2", "SUBSCRIBE "+name); res != "a2 OK SUBSCRIBE completed" {
+			t.Fatalf("SUBSCRIBE %s returned %q", name, res)
+		}
+	}
+	if _, res := c.cmd("a3", "UNSUBSCRIBE Missing"); res != "a3 NO [NONEXISTENT] Mailbox does not exist" {
+		t.Fatalf("UNSUBSCRIBE returned %q", res)
+	}
+	tests := []struct {
+		args     string
+		untagged []string
+	}{
+		{`"" "*"`, []string{`* LSUB () "/" "INBOX"`, `* LSUB (\Noinferiors) "/" "Archive/2012"`, `* LSUB (\Noselect) "/" "Deleted/Old"`}},
+		{`"" %`, []string{`* LSUB () "/" "INBOX"`, `* LSUB (\Noselect) "/" "Archive"`, `* LSUB (\Noselect) "/" "Deleted"`}},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a4", "LSUB "+test.args)
+		if !strings.HasPrefix(res, "a4 OK ") || !reflect.DeepEqual(untagged, test.untagged) {
+			t.Fatalf("LSUB %s returned %q %q expected %q", test.args, untagged, res, test.untagged)
+		}
+	}
+}
+
+func TestAppend(t *testing.T) {
+	b := newTestBackend()
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b, MaxMessageSize: 100})
+	c.cmd("a1", "LOGIN user pass")
+	if _, res := c.cmd("a2", `APPEND INBOX (\Seen $Work) " 7-Feb-1994 21:52:25 -0800" {13}`); res != "+ Ready for literal data" {
+		t.Fatalf("expected continuation request, got %q", res)
+	}
+	if _, res := c.cont("a2", "Subject: Hi\r\n"); res != "a2 OK APPEND completed" {
+		t.Fatalf("APPEND returned %q", res)
+	}
+	if _, res := c.cmd("a3", "APPEND Missing {2+}\r\nHi"); res != "a3 NO [TRYCREATE] Mailbox does not exist" {
+		t.Fatalf("APPEND returned %q", res)
+	}
+	if _, res := c.cmd("a4", `APPEND INBOX {101}`); res != "a4 NO [TOOBIG] Literal exceeds the maximum message size" {
+		t.Fatalf("APPEND returned %q", res)
+	}
+	if _, res := c.cmd("a5", "APPEND INBOX (\\Recent) {2+}\r\nHi"); res != "a5 BAD Invalid flags" {
+		t.Fatalf("APPEND returned %q", res)
+	}
+
+	msgs := b.boxes["INBOX"].messages
+	if len(msgs) != 1 {
+		t.Fatalf("expected 1 message, got %d", len(msgs))
+	}
+	date := time.Date(1994, 2, 7, 21, 52, 25, 0, time.FixedZone("", -8*60*60))
+	if !reflect.DeepEqual(msgs[0].flags, []string{FlagSeen, "$Work"}) || !msgs[0].date.Equal(date) || string(msgs[0].body) != "Subject: Hi\r\n" {
+		t.Fatalf("appended message %+v is not as expected", msgs[0])
+	}
+}
+
+// newTestMailbox returns a mailbox with count messages with UIDs
+// starting at 10.
+func newTestMailbox(count int) *testMailbox {
+	mb := &testMailbox{nextUID: 10}
+	for i := 0; i < count; i++ {
+		mb.Append([]string{}, time.Date(2012, 6, 12, 8, 9, 48, 0, time.UTC), []byte("Subject: Test\r\n\r\nHello\r\n"))
+	}
+	return mb
+}
+
+func TestStore(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(3)
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	tests := []struct {
+		command  string
+		untagged []string
+		res      string
+	}{
+		{`STORE 1:2 +FLAGS (\Seen \Flagged)`, []string{`* 1 FETCH (FLAGS (\Seen \Flagged))`, `* 2 FETCH (FLAGS (\Seen \Flagged))`}, "a3 OK STORE completed"},
+		{`STORE 2 -FLAGS.SILENT \Seen`, nil, "a3 OK STORE completed"},
+		{`UID STORE 11:* FLAGS ($Work)`, []string{`* 2 FETCH (FLAGS ($Work) UID 11)`, `* 3 FETCH (FLAGS ($Work) UID 12)`}, "a3 OK STORE completed"},
+		{`STORE 1 +FLAGS.SILENT (\Recent)`, nil, "a3 BAD Invalid flags"},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a3", test.command)
+		if res != test.res || !reflect.DeepEqual(untagged, test.untagged) {
+			t.Fatalf("%s returned %q %q expected %q %q", test.command, untagged, res, test.untagged, test.res)
+		}
+	}
+	if _, res := c.cmd("a4", `STORE 1 +FLAGS (a[b c)])`); res != "a4 BAD Invalid flags" {
+		t.Fatalf("STORE returned %q for an invalid keyword", res)
+	}
+	if flags := b.boxes["INBOX"].messages[0].flags; !reflect.DeepEqual(flags, []string{FlagSeen, FlagFlagged}) {
+		t.Fatalf("flags are %q", flags)
+	}
+}
+
+func TestExpunge(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(5)
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	c.cmd("a3", `STORE 2,3,5 +FLAGS.SILENT (\Deleted)`)
+	untagged, res := c.cmd("a4", "EXPUNGE")
+	exp := []string{"* 2 EXPUNGE", "* 2 EXPUNGE", "* 3 EXPUNGE"}
+	if res != "a4 OK EXPUNGE completed" || !reflect.DeepEqual(untagged, exp) {
+		t.Fatalf("EXPUNGE returned %q %q expected %q", untagged, res, exp)
+	}
+	if n := len(b.boxes["INBOX"].messages); n != 2 {
+		t.Fatalf("%d messages left after EXPUNGE expected 2", n)
+	}
+
+	c.cmd("a5", `STORE 1 +FLAGS.SILENT (\Deleted)`)
+	untagged, res = c.cmd("a6", "CLOSE")
+	if len(untagged) != 0 || !strings.HasPrefix(res, "a6 OK") {
+		t.Fatalf("CLOSE returned %q %q", untagged, res)
+	}
+	if msgs := b.boxes["INBOX"].messages; len(msgs) != 1 || msgs[0].uid != 13 {
+		t.Fatalf("CLOSE left %d messages", len(msgs))
+	}
+}
+
+func TestCopy(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(3)
+	b.boxes["Sent Items"] = &testMailbox{nextUID: 1}
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	c.cmd("a3", `STORE 3 FLAGS.SILENT (\Answered)`)
+	if _, res := c.cmd("a4", `COPY 3,1 "Sent Items"`); res != "a4 OK COPY completed" {
+		t.Fatalf("COPY returned %q", res)
+	}
+	if _, res := c.cmd("a5", `UID COPY 11 "Sent Items"`); res != "a5 OK COPY completed" {
+		t.Fatalf("UID COPY returned %q", res)
+	}
+	msgs := b.boxes["Sent Items"].messages
+	if len(msgs) != 3 || len(msgs[0].flags) != 0 || !reflect.DeepEqual(msgs[1].flags, []string{FlagAnswered}) {
+		t.Fatalf("COPY copied %d messages", len(msgs))
+	}
+	if !msgs[0].date.Equal(b.boxes["INBOX"].messages[0].date) || string(msgs[2].body) != string(b.boxes["INBOX"].messages[1].body) {
+		t.Fatalf("COPY did not keep the date and body")
+	}
+	if _, res := c.cmd("a6", "COPY 1 Missing"); res != "a6 NO [TRYCREATE] Mailbox does not exist" {
+		t.Fatalf("COPY to a missing mailbox returned %q", res)
+	}
+
+	// A failed copy leaves the destination unchanged.
+	trash := &testMailbox{nextUID: 1, maxMessages: 2}
+	trash.Append([]string{FlagDeleted}, time.Now(), []byte("Subject: Old\r\n\r\n"))
+	b.boxes["Trash"] = trash
+	if _, res := c.cmd("a7", "COPY 1:3 Trash"); res != "a7 NO internal error" {
+		t.Fatalf("COPY to a full mailbox returned %q", res)
+	}
+	if len(trash.messages) != 1 || trash.messages[0].uid != 1 || !reflect.DeepEqual(trash.messages[0].flags, []string{FlagDeleted}) {
+		t.Fatalf("failed COPY left %d messages", len(trash.messages))
+	}
+
+	// Several messages can't be copied if a failure couldn't be undone.
+	b.boxes["Outbox"] = &testMailbox{nextUID: 1, appendOnly: true}
+	if _, res := c.cmd("a8", "COPY 1:2 Outbox"); res != "a8 NO [CANNOT] Messages can not be copied to this mailbox" {
+		t.Fatalf("COPY to an append-only mailbox returned %q", res)
+	}
+	if _, res := c.cmd("a9", "COPY 1 Outbox"); res != "a9 OK COPY completed" {
+		t.Fatalf("COPY of a message to an append-only mailbox returned %q", res)
+	}
+}
+
+func TestFetch(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(4)
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	c.cmd("a3", `STORE 2 +FLAGS.SILENT (\Deleted)`)
+	c.cmd("a4", "EXPUNGE")
+	tests := []struct {
+		command  string
+		untagged []string
+	}{
+		{"FETCH 2:* (UID FLAGS)", []string{"* 2 FETCH (UID 12 FLAGS ())", "* 3 FETCH (UID 13 FLAGS ())"}},
+		{"FETCH *,1 UID", []string{"* 1 FETCH (UID 10)", "* 3 FETCH (UID 13)"}},
+		{"FETCH 5:* UID", []string{"* 3 FETCH (UID 13)"}},
+		{"UID FETCH 11:12 FLAGS", []string{"* 2 FETCH (FLAGS () UID 12)"}},
+		{"UID FETCH * UID", []string{"* 3 FETCH (UID 13)"}},
+		// Overlapping ranges return each message once and macros are case-insensitive
+		{"FETCH 3,1:2,2 fast", []string{"* 1 FETCH (FLAGS () INTERNALDATE \"12-Jun-2012 08:09:48 +0000\" RFC822.SIZE 24)", "* 2 FETCH (FLAGS () INTERNALDATE \"12-Jun-2012 08:09:48 +0000\" RFC822.SIZE 24)", "* 3 FETCH (FLAGS () INTERNALDATE \"12-Jun-2012 08:09:48 +0000\" RFC822.SIZE 24)"}},
+		{"FETCH 1 (BODY.PEEK[HEADER.FIELDS (SUBJECT)] BODY.PEEK[TEXT]<1.3>)", []string{"* 1 FETCH (BODY[HEADER.FIELDS (SUBJECT)] {17}", "Subject: Test", "", " BODY[TEXT]<1> {3}", "ell)"}},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a5", test.command)
+		if res != "a5 OK Success" || !reflect.DeepEqual(untagged, test.untagged) {
+			t.Fatalf("%s returned %q %q expected %q", test.command, untagged, res, test.untagged)
+		}
+	}
+	for _, command := range []string{"FETCH 1 ()", "FETCH 1 (FLAGS junk!! UID)", `FETCH 1 (FLAGS "UID")`, `FETCH 1 "FLAGS"`} {
+		if untagged, res := c.cmd("a6", command); untagged != nil || res != "a6 BAD invalid item names" {
+			t.Fatalf("%s returned %q %q", command, untagged, res)
+		}
+	}
+}
+
+func TestSearch(t *testing.T) {
+	b := newTestBackend()
+	mb := newTestMailbox(0)
+	mb.Append([]string{FlagSeen}, time.Date(2012, 6, 12, 8, 9, 48, 0, time.UTC), []byte("From: joe@example.com\r\nSubject: Lunch\r\n\r\nSoup\r\n"))
+	mb.Append([]string{}, time.Date(2012, 6, 13, 8, 9, 48, 0, time.UTC), []byte("From: ann@example.com\r\nSubject: Dinner\r\n\r\nSoup and bread\r\n"))
+	mb.Append([]string{FlagFlagged}, time.Date(2012, 6, 14, 8, 9, 48, 0, time.UTC), []byte("From: joe@example.com\r\nSubject: Re: Dinner\r\n\r\nYes\r\n"))
+	b.boxes["INBOX"] = mb
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	tests := []struct {
+		command string
+		results string
+	}{
+		{"SEARCH ALL", "* SEARCH 1 2 3"},
+		{"SEARCH FROM joe UNSEEN", "* SEARCH 3"},
+		{`SEARCH OR SEEN FLAGGED`, "* SEARCH 1 3"},
+		{`SEARCH NOT (SUBJECT dinner)`, "* SEARCH 1"},
+		{`SEARCH CHARSET UTF-8 BODY soup SINCE 13-Jun-2012`, "* SEARCH 2"},
+		{`SEARCH 2:* TEXT "Re:"`, "* SEARCH 3"},
+		{`UID SEARCH BODY soup`, "* SEARCH 10 11"},
+		{`UID SEARCH UID 11:*`, "* SEARCH 11 12"},
+		{`SEARCH LARGER 1000`, "* SEARCH"},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a3", test.command)
+		if res != "a3 OK SEARCH completed" || !reflect.DeepEqual(untagged, []string{test.results}) {
+			t.Fatalf("%s returned %q %q expected %q", test.command, untagged, res, test.results)
+		}
+	}
+	if _, res := c.cmd("a4", "SEARCH CHARSET KOI8-R ALL"); res != "a4 NO [BADCHARSET (US-ASCII UTF-8)] Unsupported charset" {
+		t.Fatalf("SEARCH with an unknown charset returned %q", res)
+	}
+	if _, res := c.cmd("a5", "SEARCH FROM"); !strings.HasPrefix(res, "a5 BAD") {
+		t.Fatalf("SEARCH with a missing argument returned %q", res)
+	}
+}
+
+func TestExamine(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(2)
+	b.boxes["Archive/2012"] = newTestMailbox(1)
+	b.boxes["Archive/2012"].readOnly = true
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	untagged, res := c.cmd("a2", "EXAMINE INBOX")
+	if res != "a2 OK [READ-ONLY] Completed" || untagged[1] != "* OK [PERMANENTFLAGS ()] No permanent flags permitted" {
+		t.Fatalf("EXAMINE returned %q %q", untagged, res)
+	}
+	tests := []struct {
+		command string
+		res     string
+	}{
+		{`STORE 1 +FLAGS (\Seen)`, "a3 NO Mailbox is read-only"},
+		{"EXPUNGE", "a3 NO Mailbox is read-only"},
+		{"FETCH 1 UID", "a3 OK Success"},
+	}
+	for _, test := range tests {
+		if _, res := c.cmd("a3", test.command); res != test.res {
+			t.Fatalf("%s returned %q expected %q", test.command, res, test.res)
+		}
+	}
+	c.cmd("a4", "APPEND inbox {5}")
+	if _, res := c.cont("a4", "Hello"); res != "a4 NO Mailbox is read-only" {
+		t.Fatalf("APPEND to an examined mailbox returned %q", res)
+	}
+	if b.boxes["INBOX"].recentCleared {
+		t.Fatalf("EXAMINE cleared the recent flags")
+	}
+
+	c.cmd("a5", `SELECT INBOX`)
+	if !b.boxes["INBOX"].recentCleared {
+		t.Fatalf("SELECT didn't clear the recent flags")
+	}
+	if _, res := c.cmd("a6", `SELECT Archive/2012`); res != "a6 OK [READ-ONLY] Completed" {
+		t.Fatalf("SELECT of a read-only mailbox returned %q", res)
+	}
+	if _, res := c.cmd("a7", `COPY 1 Archive/2012`); res != "a7 NO Mailbox is read-only" {
+		t.Fatalf("COPY to a read-only mailbox returned %q", res)
+	}
+}
+
+func TestFetchSeen(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(2)
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "EXAMINE INBOX")
+	tests := []struct {
+		command  string
+		untagged []string
+	}{
+		// EXAMINE doesn't set \Seen
+		{"FETCH 1 BODY[]<0.4>", []string{"* 1 FETCH (BODY[]<0> {4}", "Subj)"}},
+		{"SELECT INBOX", nil},
+		{"FETCH 2 BODY.PEEK[TEXT]", []string{"* 2 FETCH (BODY[TEXT] {7}", "Hello", ")"}},
+		{"FETCH 1 BODY[TEXT]", []string{"* 1 FETCH (BODY[TEXT] {7}", "Hello", " FLAGS (\\Seen))"}},
+		{"FETCH 1:2 (FLAGS BODY.PEEK[TEXT]<0.2>)", []string{"* 1 FETCH (FLAGS (\\Seen) BODY[TEXT]<0> {2}", "He)", "* 2 FETCH (FLAGS () BODY[TEXT]<0> {2}", "He)"}},
+		{"UID FETCH 10:11 RFC822.TEXT", []string{"* 1 FETCH (RFC822.TEXT {7}", "Hello", " UID 10)", "* 2 FETCH (RFC822.TEXT {7}", "Hello", " UID 11 FLAGS (\\Seen))"}},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a3", test.command)
+		if test.untagged != nil && (res != "a3 OK Success" || !reflect.DeepEqual(untagged, test.untagged)) {
+			t.Fatalf("%s returned %q %q expected %q", test.command, untagged, res, test.untagged)
+		}
+	}
+}
+
+func TestIdle(t *testing.T) {
+	b := newTestBackend()
+	mb := newTestMailbox(2)
+	b.boxes["INBOX"] = mb
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	if _, res := c.cmd("a2", "IDLE"); res != "+ idling" {
+		t.Fatalf("expected continuation request, got %q", res)
+	}
+	if untagged, res := c.cont("a2", "DONE"); untagged != nil || res != "a2 OK IDLE terminated" {
+		t.Fatalf("IDLE returned %q %q", untagged, res)
+	}
+	c.cmd("a3", "SELECT INBOX")
+	// Changes made before IDLE are sent once it's in progress.
+	mb.notify(MailboxUpdate{Kind: UpdateExists, UID: 12})
+	mb.notify(MailboxUpdate{Kind: UpdateExists, UID: 13})
+	mb.notify(MailboxUpdate{Kind: UpdateExpunge, UID: 10})
+	mb.notify(MailboxUpdate{Kind: UpdateFlags, UID: 13, Flags: []string{FlagSeen}})
+	exp := []string{"* 4 EXISTS", "* 1 EXPUNGE", "* 3 FETCH (FLAGS (\\Seen))"}
+	if untagged, res := c.cmd("a4", "IDLE"); res != "+ idling" || !reflect.DeepEqual(untagged, exp) {
+		t.Fatalf("IDLE returned %q %q expected %q", untagged, res, exp)
+	}
+	mb.notify(MailboxUpdate{Kind: UpdateExpunge, UID: 11})
+	if line := c.readLine(); line != "* 1 EXPUNGE" {
+		t.Fatalf("IDLE sent %q expected * 1 EXPUNGE", line)
+	}
+	if untagged, res := c.cont("a4", "DONE"); untagged != nil || res != "a4 OK IDLE terminated" {
+		t.Fatalf("IDLE returned %q %q", untagged, res)
+	}
+	c.cmd("a5", "CLOSE")
+	if mb.notify != nil {
+		t.Fatal("mailbox still watched after CLOSE")
+	}
+}
+
+func TestSelectDelivery(t *testing.T) {
+	b := newTestBackend()
+	mb := newTestMailbox(2)
+	b.boxes["INBOX"] = mb
+	// A message delivered while selecting is included in EXISTS.
+	mb.afterInfo = func() {
+		mb.Append(nil, time.Now(), []byte("Subject: New\r\n\r\n"))
+	}
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	untagged, _ := c.cmd("a2", "SELECT INBOX")
+	if !containsLine(untagged, "* 3 EXISTS") {
+		t.Fatalf("SELECT returned %q expected * 3 EXISTS", untagged)
+	}
+}
+
+func containsLine(lines []string, line string) bool {
+	for _, l := range lines {
+		if l == line {
+			return true
+		}
+	}
+	return false
+}
+
+func TestUpdates(t *testing.T) {
+	b := newTestBackend()
+	mb := newTestMailbox(3)
+	b.boxes["INBOX"] = mb
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	mb.messages = mb.messages[1:]
+	mb.notify(MailboxUpdate{Kind: UpdateExpunge, UID: 10})
+	mb.notify(MailboxUpdate{Kind: UpdateFlags, UID: 11, Flags: []string{FlagSeen}})
+	tests := []struct {
+		command  string
+		untagged []string
+		res      string
+	}{
+		// EXPUNGE is held back during FETCH, STORE and SEARCH.
+		{"FETCH 3 FLAGS", []string{"* 2 FETCH (FLAGS (\\Seen))", "* 3 FETCH (FLAGS ())"}, "a3 OK Success"},
+		{"SEARCH ALL", []string{"* SEARCH 2 3"}, "a3 OK SEARCH completed"},
+		{"NOOP", []string{"* 1 EXPUNGE"}, "a3 OK NOOP completed"},
+		{"CHECK", nil, "a3 OK CHECK completed"},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a3", test.command)
+		if res != test.res || !reflect.DeepEqual(untagged, test.untagged) {
+			t.Fatalf("%s returned %q %q expected %q %q", test.command, untagged, res, test.untagged, test.res)
+		}
+	}
+	mb.notify(MailboxUpdate{Kind: UpdateExpunge, UID: 11})
+	if untagged, _ := c.cmd("a4", "UID FETCH 12 FLAGS"); !reflect.DeepEqual(untagged, []string{"* 1 EXPUNGE", "* 1 FETCH (FLAGS () UID 12)"}) {
+		t.Fatalf("UID FETCH returned %q", untagged)
+	}
+}
+
+func TestUpdateOutOfOrder(t *testing.T) {
+	b := newTestBackend()
+	mb := newTestMailbox(2)
+	b.boxes["INBOX"] = mb
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	// Only the message with a UID below the known ones is reported.
+	mb.messages = append([]*testMessage{{uid: 9}}, mb.messages...)
+	mb.Append(nil, time.Now(), []byte("Subject: New\r\n\r\n"))
+	mb.notify(MailboxUpdate{Kind: UpdateExists, UID: 9})
+	exp := []string{"* 3 EXISTS"}
+	if untagged, res := c.cmd("a3", "NOOP"); res != "a3 OK NOOP completed" || !reflect.DeepEqual(untagged, exp) {
+		t.Fatalf("NOOP returned %q %q expected %q", untagged, res, exp)
+	}
+	if untagged, _ := c.cmd("a4", "FETCH 3 UID"); !reflect.DeepEqual(untagged, []string{"* 3 FETCH (UID 12)"}) {
+		t.Fatalf("FETCH returned %q", untagged)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	b := newTestBackend()
+	b.polling = true
+	mb := newTestMailbox(3)
+	b.boxes["INBOX"] = mb
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	mb.messages = append(mb.messages[:1], mb.messages[2:]...)
+	mb.Append(nil, time.Now(), []byte("Subject: New\r\n\r\n"))
+	mb.Append(nil, time.Now(), []byte("Subject: New\r\n\r\n"))
+	// Changes are only found by NOOP and CHECK.
+	if untagged, _ := c.cmd("a3", "FETCH 3 UID"); !reflect.DeepEqual(untagged, []string{"* 3 FETCH (UID 12)"}) {
+		t.Fatalf("FETCH returned %q", untagged)
+	}
+	exp := []string{"* 2 EXPUNGE", "* 4 EXISTS"}
+	if untagged, res := c.cmd("a4", "NOOP"); res != "a4 OK NOOP completed" || !reflect.DeepEqual(untagged, exp) {
+		t.Fatalf("NOOP returned %q %q expected %q", untagged, res, exp)
+	}
+	if untagged, _ := c.cmd("a5", "CHECK"); untagged != nil {
+		t.Fatalf("CHECK returned %q", untagged)
+	}
+}
+
+func TestStatus(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(2)
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	tests := []struct {
+		command  string
+		untagged []string
+		res      string
+	}{
+		{"STATUS inbox (MESSAGES uidnext UNSEEN)", []string{`* STATUS "inbox" (MESSAGES 2 UIDNEXT 12 UNSEEN 2)`}, "a2 OK STATUS completed"},
+		{"STATUS INBOX (MESSAGES BOGUS)", nil, "a2 BAD Invalid status item BOGUS"},
+		{`STATUS INBOX ("MESSAGES")`, nil, `a2 BAD Invalid status item "MESSAGES"`},
+		{"STATUS INBOX ()", nil, "a2 BAD Missing mailbox and item names"},
+		{"STATUS Missing (MESSAGES)", nil, "a2 NO unknown mailbox"},
+	}
+	for _, test := range tests {
+		untagged, res := c.cmd("a2", test.command)
+		if res != test.res || !reflect.DeepEqual(untagged, test.untagged) {
+			t.Fatalf("%s returned %q %q expected %q %q", test.command, untagged, res, test.untagged, test.res)
+		}
+	}
+}
+
+func TestIdlePoll(t *testing.T) {
+	b := newTestBackend()
+	b.polling = true
+	mb := newTestMailbox(2)
+	b.boxes["INBOX"] = mb
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b, PollInterval: 10 * time.Millisecond})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	if _, res := c.cmd("a3", "IDLE"); res != "+ idling" {
+		t.Fatalf("expected continuation request, got %q", res)
+	}
+	mb.Append(nil, time.Now(), []byte("Subject: New\r\n\r\n"))
+	if line := c.readLine(); line != "* 3 EXISTS" {
+		t.Fatalf("IDLE sent %q expected * 3 EXISTS", line)
+	}
+	if untagged, res := c.cont("a3", "DONE"); untagged != nil || res != "a3 OK IDLE terminated" {
+		t.Fatalf("IDLE returned %q %q", untagged, res)
+	}
+}
+
+func TestAppendSelected(t *testing.T) {
+	b := newTestBackend()
+	b.boxes["INBOX"] = newTestMailbox(2)
+	c := newTestConn(t, &Server{InsecureLogin: true, Backend: b})
+	c.cmd("a1", "LOGIN user pass")
+	c.cmd("a2", "SELECT INBOX")
+	exp := []string{"* 3 EXISTS"}
+	if untagged, res := c.cmd("a3", "APPEND inbox {5+}\r\nHello"); res != "a3 OK APPEND completed" || !reflect.DeepEqual(untagged, exp) {
+		t.Fatalf("APPEND returned %q %q expected %q", untagged, res, exp)
+	}
+	exp = []string{"* 5 EXISTS"}
+	if untagged, res := c.cmd("a4", "COPY 2:3 INBOX"); res != "a4 OK COPY completed" || !reflect.DeepEqual(untagged, exp) {
+		t.Fatalf("COPY returned %q %q expected %q", untagged, res, exp)
+	}
+	if untagged, _ := c.cmd("a5", "FETCH 1:* UID"); len(untagged) != 5 {
+		t.Fatalf("FETCH returned %q", untagged)
+	}
+}
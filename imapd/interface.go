@@ -2,10 +2,15 @@ package imapd
 
 import (
 	"errors"
+	"time"
 )
 
 var (
-	ErrUnknownMailbox = errors.New("imapd: no such mailbox")
+	ErrUnknownMailbox       = errors.New("imapd: no such mailbox")
+	ErrMailboxExists        = errors.New("imapd: mailbox already exists")
+	ErrAuthenticationFailed = errors.New("imapd: authentication failed")
+
+	errAuthenticationCancelled = errors.New("imapd: authentication cancelled")
 )
 
 type MailboxResponse struct {
@@ -30,20 +35,199 @@ type MailboxInfo struct {
 	Exists      uint32
 	Recent      uint32
 	Unseen      uint32
+	// The mailbox can't be modified. It's always selected read-only and
+	// doesn't accept new messages.
+	ReadOnly bool
 	// Flags []string
 }
 
+// StoreMode is the way STORE changes the flags of a message.
+type StoreMode int
+
+const (
+	StoreReplace StoreMode = iota // FLAGS: replace the flags
+	StoreAdd                      // +FLAGS: add to the flags
+	StoreRemove                   // -FLAGS: remove from the flags
+)
+
+// MessageFlags are the flags of a message after a STORE.
+type MessageFlags struct {
+	UID   uint32
+	Flags []string
+}
+
 type MessageDataItem struct {
 	Item MessageDataItemName
 	Data interface{}
 }
 
+// FetchFunc is called by FetchMessages with the UID and the requested data
+// of each message. Returning an error stops the fetch.
+type FetchFunc func(uid uint32, data []MessageDataItem) error
+
 type Mailbox interface {
 	Info() (MailboxInfo, error)
-	FetchMessagesByUID([]Range, []MessageDataItemName) (map[uint32][]MessageDataItem, error)
+	// FetchMessages calls fn for each message with a UID in uids in
+	// ascending UID order and returns the first error returned by fn. The
+	// server writes the response for a message before fn returns so the
+	// data doesn't need to be kept once fn has returned. fn may call
+	// StoreFlags to set the \Seen flag of the message.
+	FetchMessages(uids []Range, items []MessageDataItemName, fn FetchFunc) error
 }
 
 type Backend interface {
-	// ListMailboxes(reference, mailbox string) ([]*MailboxResponse, error)
+	// ListMailboxes returns all of the user's mailboxes. Reference names
+	// and wildcards of LIST and LSUB are resolved by the server.
+	ListMailboxes() ([]*MailboxResponse, error)
 	Mailbox(name string) (Mailbox, error)
 }
+
+// Authenticator is implemented by a Backend that can verify user
+// credentials. Login returns the Backend used to access the user's
+// mailboxes for the rest of the session, or ErrAuthenticationFailed
+// if the credentials are invalid. A Server whose Backend does not
+// implement Authenticator rejects all logins.
+type Authenticator interface {
+	Login(username, password string) (Backend, error)
+}
+
+// UserLookup is implemented by a Backend that can return the Backend of a
+// user whose identity was established without a password, such as by a
+// challenge-response SASL mechanism.
+type UserLookup interface {
+	LookupUser(username string) (Backend, error)
+}
+
+// ScramAuthenticator is implemented by a Backend that supports the
+// SCRAM-SHA-1 and SCRAM-SHA-256 SASL mechanisms. ScramCredentials
+// returns the stored credentials for the named hash ("SHA-1" or
+// "SHA-256") which can be created with NewScramCredentials.
+type ScramAuthenticator interface {
+	UserLookup
+	ScramCredentials(username, hashName string) (*ScramCredentials, error)
+}
+
+// CramMD5Authenticator is implemented by a Backend that supports the
+// CRAM-MD5 SASL mechanism. CramMD5Secret returns the secret shared
+// with the user.
+type CramMD5Authenticator interface {
+	UserLookup
+	CramMD5Secret(username string) (string, error)
+}
+
+// MailboxManager is implemented by a Backend that allows clients to
+// create, delete and rename mailboxes. The methods return
+// ErrUnknownMailbox or ErrMailboxExists as appropriate. Missing levels
+// of hierarchy are created by the server before calling CreateMailbox or
+// RenameMailbox.
+type MailboxManager interface {
+	CreateMailbox(name string) error
+	// DeleteMailbox removes a mailbox. A mailbox with inferior
+	// hierarchical names may be kept with the \Noselect attribute.
+	DeleteMailbox(name string) error
+	// RenameMailbox renames a mailbox along with its inferior
+	// hierarchical names. Renaming INBOX moves all of its messages to
+	// the new mailbox and leaves INBOX empty.
+	RenameMailbox(oldName, newName string) error
+}
+
+// Subscriber is implemented by a Backend that keeps a persistent list of
+// the user's subscribed mailboxes which is returned by LSUB. The list may
+// include names of mailboxes that don't exist. Unsubscribe returns
+// ErrUnknownMailbox if the name isn't subscribed.
+type Subscriber interface {
+	Subscriptions() ([]string, error)
+	Subscribe(name string) error
+	Unsubscribe(name string) error
+}
+
+// Appender is implemented by a Mailbox that accepts new messages from the
+// APPEND command. Flags never include \Recent.
+type Appender interface {
+	Append(flags []string, date time.Time, message []byte) error
+}
+
+// UIDLister is implemented by a Mailbox that can list the UIDs of all of
+// its messages in ascending order, which is also the order of message
+// sequence numbers. The server uses the list to map sequence numbers to
+// UIDs. For a Mailbox that does not implement UIDLister, the UIDs are
+// fetched with FetchMessages instead.
+type UIDLister interface {
+	UIDs() ([]uint32, error)
+}
+
+// FlagStorer is implemented by a Mailbox that allows the flags of messages
+// to be changed with STORE. It returns the resulting flags of the affected
+// messages.
+type FlagStorer interface {
+	StoreFlags(uids []Range, mode StoreMode, flags []string) ([]MessageFlags, error)
+}
+
+// Expunger is implemented by a Mailbox that can permanently remove the
+// messages that have the \Deleted flag. Expunge returns the UIDs of the
+// removed messages.
+type Expunger interface {
+	Expunge() ([]uint32, error)
+}
+
+// Copier is implemented by a Mailbox that can copy messages to another
+// mailbox of the same backend more efficiently than fetching and appending
+// them. The flags and internal date of the messages are kept. If copying
+// fails the destination must be left unchanged (RFC 3501 section 6.4.7).
+//
+// Without a Copier, COPY appends the messages to the destination one at a
+// time. If appending fails, the messages already appended are removed
+// with StoreFlags and Expunge, so copying several messages needs a
+// destination that is also a FlagStorer and Expunger.
+type Copier interface {
+	CopyMessages(uids []Range, dest Mailbox) error
+}
+
+// Searcher is implemented by a Mailbox that can search its messages. Search
+// returns the UIDs of the messages matching the criteria. A Mailbox that
+// does not implement Searcher is searched by fetching its messages and
+// matching them with SearchCriteria.Match.
+type Searcher interface {
+	Search(criteria *SearchCriteria) ([]uint32, error)
+}
+
+// UpdateKind is the kind of change of a mailbox reported by a Notifier.
+type UpdateKind int
+
+const (
+	UpdateExists  UpdateKind = iota // a message was added
+	UpdateExpunge                   // a message was permanently removed
+	UpdateFlags                     // the flags of a message changed
+)
+
+// MailboxUpdate is a change of a mailbox such as the delivery of a message
+// or a change made by another session.
+type MailboxUpdate struct {
+	Kind  UpdateKind
+	UID   uint32
+	Flags []string // the new flags of the message for UpdateFlags
+}
+
+// Notifier is implemented by a Mailbox that reports changes made outside
+// of it while it's selected, which are sent to the client as untagged
+// responses. Watch calls fn for each change until stop is called and
+// must not call it after stop returns. fn doesn't block and may be called
+// from any goroutine. Changes made through the Mailbox itself shouldn't be
+// reported. The server lists the UIDs of the selected mailbox itself after
+// it adds messages with APPEND or COPY.
+//
+// Without a Notifier the server lists the UIDs on NOOP and CHECK, and
+// every Server.PollInterval during IDLE, to find added and expunged
+// messages. Changes of flags made outside of the
+// session are only reported by a Notifier.
+type Notifier interface {
+	Watch(fn func(MailboxUpdate)) (stop func())
+}
+
+// RecentClearer is implemented by a Mailbox that keeps the \Recent flag.
+// ClearRecent is called once the mailbox has been selected read-write so
+// that other sessions don't see the messages as recent. It isn't called
+// for EXAMINE.
+type RecentClearer interface {
+	ClearRecent() error
+}
@@ -0,0 +1,295 @@
+package imapd
+
+import (
+	"fmt"
+	"sort"
+)
+
+// loadUIDs reads the UIDs of the messages in the selected mailbox which
+// map message sequence numbers to UIDs.
+func (s *session) loadUIDs() error {
+	uids, err := s.listUIDs()
+	if err != nil {
+		return err
+	}
+	s.uids = uids
+	return nil
+}
+
+// listUIDs returns the UIDs of the messages in the selected mailbox in
+// ascending order.
+func (s *session) listUIDs() ([]uint32, error) {
+	if l, ok := s.mailbox.(UIDLister); ok {
+		return l.UIDs()
+	}
+	uids := []uint32{}
+	info, err := s.mailbox.Info()
+	if err != nil || info.NextUid <= 1 {
+		return uids, err
+	}
+	// Ranges given to a Mailbox have * resolved.
+	all := []Range{{Start: 1, End: info.NextUid - 1}}
+	err = s.mailbox.FetchMessages(all, []MessageDataItemName{{Name: "UID"}}, func(uid uint32, data []MessageDataItem) error {
+		if n := len(uids); n > 0 && uid <= uids[n-1] {
+			return fmt.Errorf("imapd: UID %d fetched out of order", uid)
+		}
+		uids = append(uids, uid)
+		return nil
+	})
+	return uids, err
+}
+
+// seqNum returns the sequence number of the message with the UID or 0 if
+// the message isn't in the selected mailbox.
+func (s *session) seqNum(uid uint32) uint32 {
+	i := sort.Search(len(s.uids), func(i int) bool { return s.uids[i] >= uid })
+	if i < len(s.uids) && s.uids[i] == uid {
+		return uint32(i + 1)
+	}
+	return 0
+}
+
+// expunged removes the message with the UID from the sequence number map
+// and returns the sequence number it had.
+func (s *session) expunged(uid uint32) uint32 {
+	seqNum := s.seqNum(uid)
+	if seqNum != 0 {
+		s.uids = append(s.uids[:seqNum-1], s.uids[seqNum:]...)
+	}
+	return seqNum
+}
+
+// uidSet resolves * in a set of sequence numbers or, if uid is true, UIDs
+// and returns it as a set of UIDs.
+func (s *session) uidSet(set []Range, uid bool) []Range {
+	out := make([]Range, 0, len(set))
+	if uid {
+		max := uint32(0)
+		if len(s.uids) > 0 {
+			max = s.uids[len(s.uids)-1]
+		}
+		for _, r := range set {
+			out = append(out, r.resolve(max))
+		}
+		return out
+	}
+	// Sequence ranges are ordered and merged so that every message is
+	// included once, then each maps to a single range of UIDs.
+	n := uint32(len(s.uids))
+	seqs := make([]Range, 0, len(set))
+	for _, r := range set {
+		r = r.resolve(n)
+		if r.End == 0 {
+			r.End = r.Start
+		} else if r.Start > r.End {
+			r.Start, r.End = r.End, r.Start
+		}
+		if r.End > n {
+			r.End = n
+		}
+		if r.Start != 0 && r.Start <= r.End {
+			seqs = append(seqs, r)
+		}
+	}
+	sort.Slice(seqs, func(i, j int) bool { return seqs[i].Start < seqs[j].Start })
+	for i := 0; i < len(seqs); i++ {
+		start, end := seqs[i].Start, seqs[i].End
+		for i+1 < len(seqs) && seqs[i+1].Start <= end+1 {
+			i++
+			if seqs[i].End > end {
+				end = seqs[i].End
+			}
+		}
+		if start == end {
+			out = append(out, Range{Start: s.uids[start-1]})
+		} else {
+			out = append(out, Range{Start: s.uids[start-1], End: s.uids[end-1]})
+		}
+	}
+	return out
+}
+
+// watch subscribes to the changes of the selected mailbox if it's a
+// Notifier. The changes are kept until sent by sendUpdates.
+func (s *session) watch() {
+	n, ok := s.mailbox.(Notifier)
+	if !ok {
+		return
+	}
+	s.stopWatch = n.Watch(func(u MailboxUpdate) {
+		s.addUpdates(u)
+	})
+}
+
+// addUpdates adds changes of the selected mailbox to be sent by
+// sendUpdates.
+func (s *session) addUpdates(updates ...MailboxUpdate) {
+	s.updateMu.Lock()
+	s.updates = append(s.updates, updates...)
+	s.updateMu.Unlock()
+	select {
+	case s.updated <- struct{}{}:
+	default:
+	}
+}
+
+// poll finds the messages that were added to or removed from the selected
+// mailbox since the session last looked at it. A Notifier is only polled if
+// force is true. Flags aren't compared.
+func (s *session) poll(force bool) error {
+	if s.mailbox == nil {
+		return nil
+	}
+	if _, ok := s.mailbox.(Notifier); ok && !force {
+		return nil
+	}
+	uids, err := s.listUIDs()
+	if err != nil {
+		return err
+	}
+	// Pending expunges have already been removed from the mailbox.
+	s.updateMu.Lock()
+	known := s.updates
+	s.updateMu.Unlock()
+	var updates []MailboxUpdate
+	i := 0
+	for _, uid := range s.uids {
+		for i < len(uids) && uids[i] < uid {
+			i++
+		}
+		if (i == len(uids) || uids[i] != uid) && !hasUpdate(known, UpdateExpunge, uid) {
+			updates = append(updates, MailboxUpdate{Kind: UpdateExpunge, UID: uid})
+		}
+	}
+	for _, uid := range uids {
+		if n := len(s.uids); n == 0 || uid > s.uids[n-1] {
+			updates = append(updates, MailboxUpdate{Kind: UpdateExists, UID: uid})
+		} else if s.seqNum(uid) == 0 {
+			// Sequence numbers are in UID order so a message can only be
+			// announced if its UID is above all known ones.
+			s.errorf("Message %d added to mailbox %s below the last known UID %d", uid, s.name, s.uids[n-1])
+		}
+	}
+	if len(updates) > 0 {
+		s.addUpdates(updates...)
+	}
+	return nil
+}
+
+func hasUpdate(updates []MailboxUpdate, kind UpdateKind, uid uint32) bool {
+	for _, u := range updates {
+		if u.Kind == kind && u.UID == uid {
+			return true
+		}
+	}
+	return false
+}
+
+// unwatch stops watching the selected mailbox and drops unsent changes.
+func (s *session) unwatch() {
+	if s.stopWatch != nil {
+		s.stopWatch()
+		s.stopWatch = nil
+	}
+	s.updateMu.Lock()
+	s.updates = nil
+	s.updateMu.Unlock()
+	select {
+	case <-s.updated:
+	default:
+	}
+}
+
+// sendUpdates sends untagged responses for the changes of the selected
+// mailbox reported since the last call. EXPUNGE responses are held back
+// unless expunge is true since they renumber the messages (RFC 3501
+// section 7.4.1).
+func (s *session) sendUpdates(expunge bool) error {
+	s.updateMu.Lock()
+	updates := s.updates
+	s.updates = nil
+	s.updateMu.Unlock()
+	var held []MailboxUpdate
+	defer func() {
+		if len(held) > 0 {
+			s.updateMu.Lock()
+			s.updates = append(held, s.updates...)
+			s.updateMu.Unlock()
+		}
+	}()
+	// Consecutive new messages are announced by a single EXISTS, which
+	// has to be sent before responses that refer to them.
+	exists := false
+	sendExists := func() error {
+		if !exists {
+			return nil
+		}
+		exists = false
+		if err := s.sendUntagged(Number64(len(s.uids)), Atom("EXISTS")); err != nil {
+			return err
+		}
+		if err := s.sendRecent(); err != nil {
+			s.errorf("Error getting info for mailbox %s: %+v", s.name, err)
+		}
+		return nil
+	}
+	relist := false
+	for _, u := range updates {
+		switch u.Kind {
+		case UpdateExists:
+			// The message may have been listed when the mailbox was selected.
+			if n := len(s.uids); n == 0 || u.UID > s.uids[n-1] {
+				s.uids = append(s.uids, u.UID)
+				exists = true
+			} else if s.seqNum(u.UID) == 0 {
+				relist = true
+			}
+		case UpdateExpunge:
+			if !expunge {
+				held = append(held, u)
+				continue
+			}
+			if err := sendExists(); err != nil {
+				return err
+			}
+			if seqNum := s.expunged(u.UID); seqNum != 0 {
+				if err := s.sendUntagged(Number64(seqNum), Atom("EXPUNGE")); err != nil {
+					return err
+				}
+			}
+		case UpdateFlags:
+			if err := sendExists(); err != nil {
+				return err
+			}
+			if seqNum := s.seqNum(u.UID); seqNum != 0 {
+				if err := s.sendUntagged(Number64(seqNum), Atom("FETCH"), List{Atom("FLAGS"), atoms(u.Flags)}); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	if err := sendExists(); err != nil || !relist {
+		return err
+	}
+	// A new message wasn't after the known ones, which the backend may
+	// report out of order. Listing the messages finds the ones that can
+	// be announced rather than dropping the change.
+	if err := s.poll(true); err != nil {
+		s.errorf("Error listing messages of mailbox %s: %+v", s.name, err)
+		return nil
+	}
+	return s.sendUpdates(expunge)
+}
+
+// sendRecent sends RECENT if the number of recent messages changed.
+func (s *session) sendRecent() error {
+	info, err := s.mailbox.Info()
+	if err != nil {
+		return err
+	}
+	if info.Recent == s.recent {
+		return nil
+	}
+	s.recent = info.Recent
+	return s.sendUntagged(Number64(s.recent), Atom("RECENT"))
+}
@@ -0,0 +1,139 @@
+package imapd
+
+import (
+	"encoding/json"
+	"strings"
+)
+
+// OAuthError may be returned by a Server's ValidateToken function to
+// control the error challenge sent to the client (RFC 7628 section 3.2.2).
+type OAuthError struct {
+	Status  string `json:"status"`
+	Schemes string `json:"schemes,omitempty"`
+	Scope   string `json:"scope,omitempty"`
+}
+
+func (e *OAuthError) Error() string {
+	return "imapd: OAuth token rejected: " + e.Status
+}
+
+func oauthAvailable(c Connection) bool {
+	_, ok := c.Server().Backend.(UserLookup)
+	return ok && c.Server().ValidateToken != nil
+}
+
+// oauthServer implements the OAUTHBEARER (RFC 7628) and XOAUTH2 mechanisms.
+type oauthServer struct {
+	c        Connection
+	xoauth2  bool
+	failed   bool
+	username string
+	backend  Backend
+}
+
+func newOAuthBearerServer(c Connection) SASLServer {
+	return &oauthServer{c: c}
+}
+
+func newXOAuth2Server(c Connection) SASLServer {
+	return &oauthServer{c: c, xoauth2: true}
+}
+
+func (o *oauthServer) Next(response []byte) ([]byte, bool, error) {
+	if o.failed {
+		// The client acknowledged the error challenge.
+		return nil, false, ErrAuthenticationFailed
+	}
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	var username, token string
+	var ok bool
+	if o.xoauth2 {
+		username, token, ok = parseXOAuth2(string(response))
+	} else {
+		username, token, ok = parseOAuthBearer(string(response))
+	}
+	if !ok {
+		return nil, false, ErrAuthenticationFailed
+	}
+	username, err := o.c.Server().ValidateToken(username, token)
+	if err == nil {
+		o.backend, err = o.c.Server().Backend.(UserLookup).LookupUser(username)
+		if err == nil {
+			o.username = username
+			return nil, true, nil
+		}
+	}
+	if err != ErrAuthenticationFailed {
+		if _, ok := err.(*OAuthError); !ok {
+			return nil, false, err
+		}
+	}
+	return o.errorChallenge(err), false, nil
+}
+
+func (o *oauthServer) User() (string, Backend) {
+	return o.username, o.backend
+}
+
+// errorChallenge returns the JSON error sent to the client when the token
+// is rejected. The exchange then fails once the client responds.
+func (o *oauthServer) errorChallenge(err error) []byte {
+	o.failed = true
+	e, ok := err.(*OAuthError)
+	if !ok {
+		e = &OAuthError{Status: "invalid_token", Schemes: "bearer"}
+		if o.xoauth2 {
+			e = &OAuthError{Status: "401", Schemes: "Bearer"}
+		}
+	}
+	b, _ := json.Marshal(e)
+	return b
+}
+
+// parseOAuthBearer parses: gs2-header %x01 *(key=value %x01) %x01
+func parseOAuthBearer(msg string) (username, token string, ok bool) {
+	parts := strings.SplitN(msg, "\x01", 2)
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	gs2 := strings.Split(parts[0], ",")
+	if len(gs2) != 3 || gs2[0] != "n" && gs2[0] != "y" || gs2[2] != "" {
+		return "", "", false
+	}
+	if gs2[1] != "" {
+		if !strings.HasPrefix(gs2[1], "a=") {
+			return "", "", false
+		}
+		username = scramUnescape(gs2[1][2:])
+	}
+	token, ok = bearerToken(parts[1])
+	return username, token, ok
+}
+
+// parseXOAuth2 parses: user=<username> %x01 auth=Bearer <token> %x01 %x01
+func parseXOAuth2(msg string) (username, token string, ok bool) {
+	for _, kv := range strings.Split(msg, "\x01") {
+		if strings.HasPrefix(kv, "user=") {
+			username = kv[5:]
+		}
+	}
+	token, ok = bearerToken(msg)
+	return username, token, ok && username != ""
+}
+
+// bearerToken returns the token from the auth key of a %x01 separated
+// list of key=value pairs.
+func bearerToken(kvpairs string) (string, bool) {
+	for _, kv := range strings.Split(kvpairs, "\x01") {
+		if strings.HasPrefix(kv, "auth=") {
+			auth := strings.SplitN(kv[5:], " ", 2)
+			if len(auth) == 2 && strings.EqualFold(auth[0], "Bearer") && auth[1] != "" {
+				return auth[1], true
+			}
+			return "", false
+		}
+	}
+	return "", false
+}
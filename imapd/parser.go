@@ -0,0 +1,382 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+const (
+	maxLineLength = 64 << 10
+	// maxListDepth is the maximum nesting of parenthesized lists.
+	maxListDepth = 100
+	// maxShortLiteral is the maximum size of a literal other than the
+	// message of APPEND.
+	maxShortLiteral = 8 << 10
+)
+
+type argKind int
+
+const (
+	argAtom argKind = iota
+	argQuoted
+	argLiteral
+	argList
+	argNil
+)
+
+// arg is a single argument of a client command (RFC 3501 section 9)
+type arg struct {
+	kind argKind
+	str  string // value of an atom, quoted string, or literal
+	list []arg  // items of a parenthesized list
+}
+
+// astring returns the value of an atom, quoted string, or literal. The
+// atom NIL is returned as the string "NIL".
+func (a arg) astring() (string, bool) {
+	switch a.kind {
+	case argAtom, argQuoted, argLiteral:
+		return a.str, true
+	case argNil:
+		return "NIL", true
+	}
+	return "", false
+}
+
+// String returns the argument as it would be sent on the wire with
+// the exception that literals are returned as quoted strings.
+func (a arg) String() string {
+	switch a.kind {
+	case argAtom:
+		return a.str
+	case argQuoted, argLiteral:
+		return strconv.Quote(a.str)
+	case argNil:
+		return "NIL"
+	}
+	out := make([]string, len(a.list))
+	for i, it := range a.list {
+		out[i] = it.String()
+	}
+	return "(" + strings.Join(out, " ") + ")"
+}
+
+type syntaxError string
+
+func (e syntaxError) Error() string {
+	return "imapd: syntax error: " + string(e)
+}
+
+// errTooBig is returned for an APPEND message larger than the parser's
+// maxAppend.
+var errTooBig = syntaxError("literal too large")
+
+var errLiteralTooLong = syntaxError("literal too long")
+
+// parser reads commands from a client connection.
+type parser struct {
+	br *bufio.Reader
+	// cont is called before reading a synchronizing literal and
+	// should send a command continuation request to the client.
+	cont func() error
+	// maxAppend is the maximum size of the message literal of APPEND,
+	// which is only accepted once maxAppend is set after authentication.
+	maxAppend int64
+	// eol is true once the line terminator of the current command
+	// has been consumed.
+	eol bool
+	// n is the number of bytes of the current command other than an
+	// APPEND message, which is limited to maxLineLength.
+	n int
+	// depth is the nesting of the list being read.
+	depth int
+}
+
+// readByte reads a byte of a command outside of literals.
+func (p *parser) readByte() (byte, error) {
+	if p.n >= maxLineLength {
+		return 0, syntaxError("command too long")
+	}
+	c, err := p.br.ReadByte()
+	if err == nil {
+		p.n++
+	}
+	return c, err
+}
+
+func (p *parser) unreadByte() {
+	p.br.UnreadByte()
+	p.n--
+}
+
+// readCommand reads a full command line including any literals. The tag
+// is returned whenever it could be parsed, even when err is not nil. On
+// a syntaxError the rest of the line has been discarded.
+func (p *parser) readCommand() (tag, cmd string, args []arg, err error) {
+	p.eol = false
+	p.n = 0
+	p.depth = 0
+	args, err = p.readArgs(false)
+	if len(args) > 0 && args[0].kind == argAtom {
+		tag = args[0].str
+	}
+	if err != nil {
+		if _, ok := err.(syntaxError); ok {
+			p.skipLine()
+		}
+		return tag, "", nil, err
+	}
+	if tag == "" {
+		return "", "", nil, syntaxError("missing tag")
+	}
+	if len(args) < 2 || args[1].kind != argAtom {
+		return tag, "", nil, syntaxError("missing command")
+	}
+	return tag, strings.ToLower(args[1].str), args[2:], nil
+}
+
+// readLine reads a single line such as a response to an authentication
+// challenge and returns it without the line terminator.
+func (p *parser) readLine() (string, error) {
+	var line []byte
+	for {
+		b, err := p.br.ReadSlice('\n')
+		if len(line)+len(b) > maxLineLength {
+			p.eol = err == nil
+			p.skipLine()
+			return "", syntaxError("line too long")
+		}
+		line = append(line, b...)
+		if err == nil {
+			break
+		} else if err != bufio.ErrBufferFull {
+			return "", err
+		}
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// skipLine discards input up to and including the end of the current line.
+func (p *parser) skipLine() {
+	for !p.eol {
+		_, err := p.br.ReadSlice('\n')
+		if err != bufio.ErrBufferFull {
+			p.eol = true
+		}
+	}
+}
+
+// readArgs reads space separated arguments until the end of the line or,
+// when list is true, until the closing parenthesis.
+func (p *parser) readArgs(list bool) ([]arg, error) {
+	args := []arg{}
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return args, err
+		}
+		switch c {
+		case ' ':
+		case '\r', '\n':
+			if c == '\r' {
+				if c, err = p.readByte(); err != nil {
+					return args, err
+				} else if c != '\n' {
+					return args, syntaxError("expected LF after CR")
+				}
+			}
+			p.eol = true
+			if list {
+				return args, syntaxError("unterminated list")
+			}
+			return args, nil
+		case ')':
+			if !list {
+				return args, syntaxError("unexpected )")
+			}
+			return args, nil
+		case '(':
+			if p.depth >= maxListDepth {
+				return args, syntaxError("lists nested too deeply")
+			}
+			p.depth++
+			l, err := p.readArgs(true)
+			p.depth--
+			if err != nil {
+				return args, err
+			}
+			args = append(args, arg{kind: argList, list: l})
+		case '"':
+			s, err := p.readQuoted()
+			if err != nil {
+				return args, err
+			}
+			args = append(args, arg{kind: argQuoted, str: s})
+		case '{':
+			// The message of APPEND follows the mailbox name and optional
+			// flags and date.
+			message := p.depth == 0 && p.maxAppend > 0 && len(args) >= 3 &&
+				args[1].kind == argAtom && strings.EqualFold(args[1].str, "APPEND")
+			s, err := p.readLiteral(message)
+			if err != nil {
+				return args, err
+			}
+			args = append(args, arg{kind: argLiteral, str: s})
+		default:
+			p.unreadByte()
+			s, err := p.readAtom()
+			if err != nil {
+				return args, err
+			}
+			if strings.EqualFold(s, "NIL") {
+				args = append(args, arg{kind: argNil})
+			} else {
+				args = append(args, arg{kind: argAtom, str: s})
+			}
+		}
+	}
+}
+
+// readAtom reads an atom. Brackets are allowed within an atom and may
+// contain spaces and parenthesis so that fetch attributes such as
+// BODY[HEADER.FIELDS (DATE FROM)]<0.100> are read as a single atom.
+func (p *parser) readAtom() (string, error) {
+	var buf []byte
+	depth := 0
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return "", err
+		}
+		switch {
+		case c == '\r' || c == '\n':
+			if depth > 0 {
+				if c == '\n' {
+					p.eol = true
+				}
+				return "", syntaxError("unterminated [")
+			}
+			p.unreadByte()
+			return string(buf), nil
+		case c == '[':
+			depth++
+		case c == ']' && depth > 0:
+			depth--
+		case depth == 0 && (c == ' ' || c == '(' || c == ')' || c == '"'):
+			p.unreadByte()
+			return string(buf), nil
+		case c < ' ' || c == 0x7f:
+			return "", syntaxError("invalid character in atom")
+		}
+		buf = append(buf, c)
+	}
+}
+
+// readQuoted reads a quoted string after the opening quote.
+func (p *parser) readQuoted() (string, error) {
+	var buf []byte
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return "", err
+		}
+		switch c {
+		case '"':
+			return string(buf), nil
+		case '\\':
+			if c, err = p.readByte(); err != nil {
+				return "", err
+			}
+			if c != '"' && c != '\\' {
+				return "", syntaxError("invalid escape in quoted string")
+			}
+		case '\r', '\n':
+			if c == '\n' {
+				p.eol = true
+			}
+			return "", syntaxError("unterminated quoted string")
+		}
+		buf = append(buf, c)
+	}
+}
+
+// readLiteral reads a literal after the opening brace: {n}CRLF followed
+// by n octets. A synchronizing literal is preceded by a continuation
+// request. The non-synchronizing form {n+} (RFC 7888) is also accepted.
+// Literals other than an APPEND message count towards the length of the
+// command.
+func (p *parser) readLiteral(message bool) (string, error) {
+	var spec []byte
+	for {
+		c, err := p.readByte()
+		if err != nil {
+			return "", err
+		}
+		if c == '}' {
+			break
+		}
+		if (c < '0' || c > '9') && c != '+' || len(spec) > 10 {
+			p.unreadByte()
+			return "", syntaxError("invalid literal size")
+		}
+		spec = append(spec, c)
+	}
+	sync := true
+	if len(spec) > 0 && spec[len(spec)-1] == '+' {
+		sync = false
+		spec = spec[:len(spec)-1]
+	}
+	size, err := strconv.ParseUint(string(spec), 10, 32)
+	if err != nil {
+		return "", syntaxError("invalid literal size")
+	}
+	if c, err := p.br.ReadByte(); err != nil {
+		return "", err
+	} else if c == '\r' {
+		if c, err = p.br.ReadByte(); err != nil {
+			return "", err
+		} else if c != '\n' {
+			return "", syntaxError("expected CRLF after literal size")
+		}
+	} else if c != '\n' {
+		return "", syntaxError("expected CRLF after literal size")
+	}
+	var tooBig error = errLiteralTooLong
+	if message {
+		if int64(size) <= p.maxAppend {
+			tooBig = nil
+		} else {
+			tooBig = errTooBig
+		}
+	} else if size <= maxShortLiteral && p.n+int(size) <= maxLineLength {
+		p.n += int(size)
+		tooBig = nil
+	}
+	if tooBig != nil {
+		if sync {
+			// The client is waiting for a continuation so the
+			// rest of the command will never be sent.
+			p.eol = true
+		} else if _, err := io.CopyN(io.Discard, p.br, int64(size)); err != nil {
+			return "", err
+		}
+		return "", tooBig
+	}
+	if sync && p.cont != nil {
+		if err := p.cont(); err != nil {
+			return "", err
+		}
+	}
+	// The buffer grows as the data arrives rather than trusting the size.
+	var buf bytes.Buffer
+	if _, err := io.CopyN(&buf, p.br, int64(size)); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return "", err
+	}
+	return buf.String(), nil
+}
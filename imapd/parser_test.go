@@ -0,0 +1,123 @@
+package imapd
+
+import (
+	"bufio"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseCommand(t *testing.T) {
+	cont := 0
+	p := &parser{
+		br:        bufio.NewReader(strings.NewReader("a1 SELECT \"Sent Items\"\r\na2 login {4}\r\nuser pa\\ss\r\na3 UID FETCH 1:* (FLAGS BODY.PEEK[HEADER.FIELDS (DATE FROM)]<0.100>) NIL\r\n")),
+		cont:      func() error { cont++; return nil },
+		maxAppend: 1024,
+	}
+
+	tag, cmd, args, err := p.readCommand()
+	if err != nil {
+		t.Fatalf("readCommand returned error: %+v", err)
+	}
+	exp := []arg{{kind: argQuoted, str: "Sent Items"}}
+	if tag != "a1" || cmd != "select" || !reflect.DeepEqual(args, exp) {
+		t.Fatalf("readCommand returned %s %s %+v expected a1 select %+v", tag, cmd, args, exp)
+	}
+
+	tag, cmd, args, err = p.readCommand()
+	if err != nil {
+		t.Fatalf("readCommand returned error: %+v", err)
+	}
+	exp = []arg{{kind: argLiteral, str: "user"}, {kind: argAtom, str: `pa\ss`}}
+	if tag != "a2" || cmd != "login" || !reflect.DeepEqual(args, exp) {
+		t.Fatalf("readCommand returned %s %s %+v expected a2 login %+v", tag, cmd, args, exp)
+	}
+	if cont != 1 {
+		t.Fatalf("expected 1 continuation request, got %d", cont)
+	}
+
+	tag, cmd, args, err = p.readCommand()
+	if err != nil {
+		t.Fatalf("readCommand returned error: %+v", err)
+	}
+	exp = []arg{
+		{kind: argAtom, str: "FETCH"},
+		{kind: argAtom, str: "1:*"},
+		{kind: argList, list: []arg{
+			{kind: argAtom, str: "FLAGS"},
+			{kind: argAtom, str: "BODY.PEEK[HEADER.FIELDS (DATE FROM)]<0.100>"},
+		}},
+		{kind: argNil},
+	}
+	if tag != "a3" || cmd != "uid" || !reflect.DeepEqual(args, exp) {
+		t.Fatalf("readCommand returned %s %s %+v expected a3 uid %+v", tag, cmd, args, exp)
+	}
+}
+
+func TestParseCommandErrors(t *testing.T) {
+	p := &parser{br: bufio.NewReader(strings.NewReader("a1 LIST (\"\" \"*\"\r\na2 NOOP\r\na3 LOGIN \"user\\x\" pass\r\na4 APPEND INBOX {99999999}\r\na5 NOOP\r\n")), maxAppend: 1024}
+
+	if tag, _, _, err := p.readCommand(); tag != "a1" || err == nil {
+		t.Fatalf("readCommand returned %s %+v for an unterminated list", tag, err)
+	}
+	if tag, cmd, _, err := p.readCommand(); err != nil || tag != "a2" || cmd != "noop" {
+		t.Fatalf("readCommand returned %s %s %+v expected a2 noop", tag, cmd, err)
+	}
+	if tag, _, _, err := p.readCommand(); tag != "a3" || err == nil {
+		t.Fatalf("readCommand returned %s %+v for an invalid escape", tag, err)
+	}
+	if tag, _, _, err := p.readCommand(); tag != "a4" || err == nil {
+		t.Fatalf("readCommand returned %s %+v for a large literal", tag, err)
+	}
+	if tag, cmd, _, err := p.readCommand(); err != nil || tag != "a5" || cmd != "noop" {
+		t.Fatalf("readCommand returned %s %s %+v expected a5 noop", tag, cmd, err)
+	}
+}
+
+func TestParseCommandLimits(t *testing.T) {
+	input := "a1 SEARCH " + strings.Repeat("(", 2<<20) + "\r\n" +
+		"a2 NOOP\r\n" +
+		"a3 LOGIN " + strings.Repeat("x", maxLineLength) + " pass\r\n" +
+		"a4 SEARCH " + strings.Repeat("(", maxListDepth) + "ALL" + strings.Repeat(")", maxListDepth) + "\r\n"
+	p := &parser{br: bufio.NewReader(strings.NewReader(input)), maxAppend: 1024}
+
+	if tag, _, _, err := p.readCommand(); tag != "a1" || err == nil {
+		t.Fatalf("readCommand returned %s %+v for deeply nested lists", tag, err)
+	}
+	if tag, cmd, _, err := p.readCommand(); err != nil || tag != "a2" || cmd != "noop" {
+		t.Fatalf("readCommand returned %s %s %+v expected a2 noop", tag, cmd, err)
+	}
+	if tag, _, _, err := p.readCommand(); tag != "a3" || err == nil {
+		t.Fatalf("readCommand returned %s %+v for a long atom", tag, err)
+	}
+	if tag, cmd, _, err := p.readCommand(); err != nil || tag != "a4" || cmd != "search" {
+		t.Fatalf("readCommand returned %s %s %+v expected a4 search", tag, cmd, err)
+	}
+}
+
+func TestParseLiteralLimits(t *testing.T) {
+	input := "a1 LOGIN {67108864}\r\n" +
+		"a2 APPEND INBOX {100000}\r\n" +
+		"a3 APPEND INBOX (\\Seen) {10+}\r\n0123456789\r\n" +
+		"a4 LOGIN {9000+}\r\n" + strings.Repeat("x", 9000) + " pass\r\n" +
+		"a5 NOOP\r\n"
+	p := &parser{br: bufio.NewReader(strings.NewReader(input))}
+
+	if tag, _, _, err := p.readCommand(); tag != "a1" || err != errLiteralTooLong {
+		t.Fatalf("readCommand returned %s %+v for a large literal", tag, err)
+	}
+	// Large APPEND messages are only accepted after authentication.
+	if tag, _, _, err := p.readCommand(); tag != "a2" || err != errLiteralTooLong {
+		t.Fatalf("readCommand returned %s %+v for an APPEND before authentication", tag, err)
+	}
+	p.maxAppend = 100
+	if tag, _, args, err := p.readCommand(); err != nil || tag != "a3" || len(args) != 3 || args[2].str != "0123456789" {
+		t.Fatalf("readCommand returned %s %+v %+v for an APPEND", tag, args, err)
+	}
+	if tag, _, _, err := p.readCommand(); tag != "a4" || err != errLiteralTooLong {
+		t.Fatalf("readCommand returned %s %+v for a large literal", tag, err)
+	}
+	if tag, cmd, _, err := p.readCommand(); err != nil || tag != "a5" || cmd != "noop" {
+		t.Fatalf("readCommand returned %s %s %+v expected a5 noop", tag, cmd, err)
+	}
+}
@@ -0,0 +1,139 @@
+package imapd
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Value is a data value of a server response (RFC 3501 section 4).
+type Value interface {
+	appendValue(b []byte) []byte
+}
+
+// Atom is sent as is, such as a flag or the name of a response.
+type Atom string
+
+// Quoted is a string sent as a quoted string, or as a literal if it
+// contains characters that can't be quoted.
+type Quoted string
+
+// Literal is a string that is always sent as a literal.
+type Literal []byte
+
+// NString is a string that is sent as NIL when empty.
+type NString string
+
+// Number64 is an unsigned number.
+type Number64 uint64
+
+// List is a parenthesized list of values.
+type List []Value
+
+func (a Atom) appendValue(b []byte) []byte {
+	return append(b, a...)
+}
+
+func (q Quoted) appendValue(b []byte) []byte {
+	for i := 0; i < len(q); i++ {
+		if c := q[i]; c == '\r' || c == '\n' || c == 0 || c >= 0x80 {
+			return Literal(q).appendValue(b)
+		}
+	}
+	b = append(b, '"')
+	for i := 0; i < len(q); i++ {
+		if q[i] == '"' || q[i] == '\\' {
+			b = append(b, '\\')
+		}
+		b = append(b, q[i])
+	}
+	return append(b, '"')
+}
+
+func (l Literal) appendValue(b []byte) []byte {
+	b = append(b, '{')
+	b = strconv.AppendInt(b, int64(len(l)), 10)
+	b = append(b, "}\r\n"...)
+	return append(b, l...)
+}
+
+func (s NString) appendValue(b []byte) []byte {
+	if s == "" {
+		return append(b, "NIL"...)
+	}
+	return Quoted(s).appendValue(b)
+}
+
+func (n Number64) appendValue(b []byte) []byte {
+	return strconv.AppendUint(b, uint64(n), 10)
+}
+
+func (l List) appendValue(b []byte) []byte {
+	b = append(b, '(')
+	for i, v := range l {
+		if i > 0 {
+			b = append(b, ' ')
+		}
+		b = v.appendValue(b)
+	}
+	return append(b, ')')
+}
+
+// encodeValue returns the encoded value.
+func encodeValue(v Value) string {
+	return string(v.appendValue(nil))
+}
+
+// atoms returns a list of atoms such as flags.
+func atoms(s []string) List {
+	l := make(List, len(s))
+	for i, a := range s {
+		l[i] = Atom(a)
+	}
+	return l
+}
+
+// sendUntagged sends an untagged response made of the values separated by
+// spaces.
+func (s *session) sendUntagged(values ...Value) error {
+	b := []byte{'*'}
+	for _, v := range values {
+		b = append(b, ' ')
+		b = v.appendValue(b)
+	}
+	return s.sendf("%s\r\n", b)
+}
+
+// fetchValue returns the response value of data returned by a Mailbox for
+// a FETCH item.
+func fetchValue(item MessageDataItemName, data interface{}) (Value, error) {
+	switch t := data.(type) {
+	case nil:
+		return NString(""), nil
+	case *BodyStructure:
+		// BODY is BODYSTRUCTURE without extension data.
+		return t.value(item.Name == "BODYSTRUCTURE"), nil
+	case Value:
+		return t, nil
+	case int:
+		return Number64(t), nil
+	case uint32:
+		return Number64(t), nil
+	case int64:
+		return Number64(t), nil
+	case uint64:
+		return Number64(t), nil
+	case string:
+		return Quoted(t), nil
+	case []string:
+		return atoms(t), nil
+	case time.Time:
+		return Quoted(t.Format(internalDateFormat)), nil
+	case []byte:
+		if t == nil {
+			return NString(""), nil
+		}
+		return Literal(t), nil
+	}
+	return nil, fmt.Errorf("imapd: unknown type %T for %s", data, item)
+}
@@ -0,0 +1,62 @@
+package imapd
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEncodeValue(t *testing.T) {
+	tests := []struct {
+		v   Value
+		exp string
+	}{
+		{Atom(`\Seen`), `\Seen`},
+		{Quoted("INBOX"), `"INBOX"`},
+		{Quoted(""), `""`},
+		{Quoted(`say "hi" \o/`), `"say \"hi\" \\o/"`},
+		{Quoted("a\r\nb"), "{4}\r\na\r\nb"},
+		{Quoted("caf\xc3\xa9"), "{5}\r\ncaf\xc3\xa9"},
+		{Literal("abc"), "{3}\r\nabc"},
+		{Literal(""), "{0}\r\n"},
+		{NString(""), "NIL"},
+		{NString("x"), `"x"`},
+		{Number64(4294967296), "4294967296"},
+		{List{}, "()"},
+		{List{Atom("FLAGS"), atoms([]string{FlagSeen, FlagDeleted}), Atom("UID"), Number64(7)}, `(FLAGS (\Seen \Deleted) UID 7)`},
+	}
+	for _, test := range tests {
+		if s := encodeValue(test.v); s != test.exp {
+			t.Fatalf("encodeValue(%#v) returned %q expected %q", test.v, s, test.exp)
+		}
+	}
+}
+
+func TestFetchValue(t *testing.T) {
+	date := time.Date(2017, 7, 4, 12, 30, 0, 0, time.UTC)
+	tests := []struct {
+		data interface{}
+		exp  string
+	}{
+		{nil, "NIL"},
+		{12, "12"},
+		{uint32(4000000000), "4000000000"},
+		{"a\"b", `"a\"b"`},
+		{[]string{FlagSeen}, `(\Seen)`},
+		{date, `"04-Jul-2017 12:30:00 +0000"`},
+		{[]byte(nil), "NIL"},
+		{[]byte("hi"), "{2}\r\nhi"},
+		{Atom("X"), "X"},
+	}
+	for _, test := range tests {
+		v, err := fetchValue(MessageDataItemName{Name: "BODY"}, test.data)
+		if err != nil {
+			t.Fatalf("fetchValue(%#v) failed: %+v", test.data, err)
+		}
+		if s := encodeValue(v); s != test.exp {
+			t.Fatalf("fetchValue(%#v) returned %q expected %q", test.data, s, test.exp)
+		}
+	}
+	if _, err := fetchValue(MessageDataItemName{Name: "BODY"}, 1.5); err == nil {
+		t.Fatal("fetchValue of an unknown type did not fail")
+	}
+}
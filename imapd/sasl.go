@@ -0,0 +1,270 @@
+package imapd
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+)
+
+// SASLServer is the server side of a single SASL authentication exchange
+// started by the AUTHENTICATE command.
+type SASLServer interface {
+	// Next is called with each response from the client and returns
+	// the next challenge. The first call receives the initial response
+	// which is nil if the client did not send one. Once done is true
+	// the user has been authenticated and any returned challenge is
+	// sent as additional data. A failed authentication should return
+	// ErrAuthenticationFailed.
+	Next(response []byte) (challenge []byte, done bool, err error)
+	// User returns the name and backend of the authenticated user once
+	// Next has reported done.
+	User() (username string, backend Backend)
+}
+
+// SASLMechanism describes a SASL mechanism available to AUTHENTICATE.
+type SASLMechanism struct {
+	// Plaintext is set for mechanisms that transmit credentials in the
+	// clear. They are only offered on a secure connection or when the
+	// server allows InsecureLogin.
+	Plaintext bool
+	// Available optionally reports whether the mechanism can be used
+	// on the connection.
+	Available func(c Connection) bool
+	// New starts a new authentication exchange.
+	New func(c Connection) SASLServer
+}
+
+// DefaultSASLMechanisms are the mechanisms offered when a Server does not
+// specify its own, keyed by upper case mechanism name.
+var DefaultSASLMechanisms = map[string]*SASLMechanism{
+	"PLAIN":              {Plaintext: true, New: newPlainServer},
+	"LOGIN":              {Plaintext: true, New: newLoginServer},
+	"CRAM-MD5":           {Available: cramMD5Available, New: newCramMD5Server},
+	"EXTERNAL":           {Available: externalAvailable, New: newExternalServer},
+	"OAUTHBEARER":        {Plaintext: true, Available: oauthAvailable, New: newOAuthBearerServer},
+	"XOAUTH2":            {Plaintext: true, Available: oauthAvailable, New: newXOAuth2Server},
+	"SCRAM-SHA-1":        scramMechanism("SHA-1", false),
+	"SCRAM-SHA-1-PLUS":   scramMechanism("SHA-1", true),
+	"SCRAM-SHA-256":      scramMechanism("SHA-256", false),
+	"SCRAM-SHA-256-PLUS": scramMechanism("SHA-256", true),
+}
+
+// saslMechanisms returns the sorted names of the mechanisms that can be
+// used on the connection.
+func (s *session) saslMechanisms() []string {
+	mechs := s.srv.SASLMechanisms
+	if mechs == nil {
+		mechs = DefaultSASLMechanisms
+	}
+	names := make([]string, 0, len(mechs))
+	for name, m := range mechs {
+		if s.saslAvailable(m) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// saslMechanism returns the named mechanism if it can be used on the connection.
+func (s *session) saslMechanism(name string) *SASLMechanism {
+	mechs := s.srv.SASLMechanisms
+	if mechs == nil {
+		mechs = DefaultSASLMechanisms
+	}
+	if m := mechs[name]; m != nil && s.saslAvailable(m) {
+		return m
+	}
+	return nil
+}
+
+func (s *session) saslAvailable(m *SASLMechanism) bool {
+	if m.Plaintext && !s.secure && !s.srv.InsecureLogin {
+		return false
+	}
+	return m.Available == nil || m.Available(s)
+}
+
+// plainServer implements the PLAIN mechanism (RFC 4616).
+type plainServer struct {
+	c        Connection
+	username string
+	backend  Backend
+}
+
+func newPlainServer(c Connection) SASLServer {
+	return &plainServer{c: c}
+}
+
+func (p *plainServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	// [authzid] NUL authcid NUL passwd
+	parts := bytes.Split(response, []byte{0})
+	if len(parts) != 3 {
+		return nil, false, ErrAuthenticationFailed
+	}
+	authzid, username, password := string(parts[0]), string(parts[1]), string(parts[2])
+	if authzid != "" && authzid != username {
+		return nil, false, ErrAuthenticationFailed
+	}
+	b, err := p.c.Server().login(username, password)
+	if err != nil {
+		return nil, false, err
+	}
+	p.username = username
+	p.backend = b
+	return nil, true, nil
+}
+
+func (p *plainServer) User() (string, Backend) {
+	return p.username, p.backend
+}
+
+// loginServer implements the obsolete but widely used LOGIN mechanism.
+type loginServer struct {
+	c        Connection
+	step     int
+	username string
+	backend  Backend
+}
+
+func newLoginServer(c Connection) SASLServer {
+	return &loginServer{c: c}
+}
+
+func (l *loginServer) Next(response []byte) ([]byte, bool, error) {
+	if l.step == 0 {
+		l.step++
+		if response == nil {
+			return []byte("Username:"), false, nil
+		}
+	}
+	switch l.step {
+	case 1:
+		l.username = string(response)
+		l.step++
+		return []byte("Password:"), false, nil
+	case 2:
+		b, err := l.c.Server().login(l.username, string(response))
+		if err != nil {
+			return nil, false, err
+		}
+		l.backend = b
+		return nil, true, nil
+	}
+	return nil, false, ErrAuthenticationFailed
+}
+
+func (l *loginServer) User() (string, Backend) {
+	return l.username, l.backend
+}
+
+// cramMD5Server implements the CRAM-MD5 mechanism (RFC 2195).
+type cramMD5Server struct {
+	c         Connection
+	challenge string
+	username  string
+	backend   Backend
+}
+
+func cramMD5Available(c Connection) bool {
+	_, ok := c.Server().Backend.(CramMD5Authenticator)
+	return ok
+}
+
+func newCramMD5Server(c Connection) SASLServer {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "localhost"
+	}
+	return &cramMD5Server{
+		c:         c,
+		challenge: fmt.Sprintf("<%s.%d@%s>", newNonce(), time.Now().Unix(), host),
+	}
+}
+
+func (m *cramMD5Server) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte(m.challenge), false, nil
+	}
+	i := bytes.LastIndexByte(response, ' ')
+	if i < 0 {
+		return nil, false, ErrAuthenticationFailed
+	}
+	digest, err := hex.DecodeString(string(response[i+1:]))
+	if err != nil {
+		return nil, false, ErrAuthenticationFailed
+	}
+	auth := m.c.Server().Backend.(CramMD5Authenticator)
+	username := string(response[:i])
+	secret, err := auth.CramMD5Secret(username)
+	if err != nil {
+		return nil, false, err
+	}
+	if !hmac.Equal(digest, scramHMAC(md5.New, []byte(secret), []byte(m.challenge))) {
+		return nil, false, ErrAuthenticationFailed
+	}
+	b, err := auth.LookupUser(username)
+	if err != nil {
+		return nil, false, err
+	}
+	m.username = username
+	m.backend = b
+	return nil, true, nil
+}
+
+func (m *cramMD5Server) User() (string, Backend) {
+	return m.username, m.backend
+}
+
+// externalServer implements the EXTERNAL mechanism (RFC 4422 appendix A)
+// using the verified TLS client certificate.
+type externalServer struct {
+	c        Connection
+	username string
+	backend  Backend
+}
+
+func externalAvailable(c Connection) bool {
+	if _, ok := c.Server().Backend.(UserLookup); !ok || c.Server().MapCertificate == nil {
+		return false
+	}
+	state, ok := c.TLSConnectionState()
+	return ok && len(state.VerifiedChains) > 0
+}
+
+func newExternalServer(c Connection) SASLServer {
+	return &externalServer{c: c}
+}
+
+func (e *externalServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	state, ok := e.c.TLSConnectionState()
+	if !ok || len(state.VerifiedChains) == 0 {
+		return nil, false, ErrAuthenticationFailed
+	}
+	username, err := e.c.Server().MapCertificate(state.VerifiedChains[0][0], string(response))
+	if err != nil {
+		return nil, false, err
+	}
+	b, err := e.c.Server().Backend.(UserLookup).LookupUser(username)
+	if err != nil {
+		return nil, false, err
+	}
+	e.username = username
+	e.backend = b
+	return nil, true, nil
+}
+
+func (e *externalServer) User() (string, Backend) {
+	return e.username, e.backend
+}
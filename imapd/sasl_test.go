@@ -0,0 +1,321 @@
+package imapd
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"math/big"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+type challengeTestBackend struct {
+	testBackend
+	scram map[string]*ScramCredentials
+}
+
+func (b *challengeTestBackend) LookupUser(username string) (Backend, error) {
+	return b, nil
+}
+
+func (b *challengeTestBackend) ScramCredentials(username, hashName string) (*ScramCredentials, error) {
+	if username != "user" || b.scram[hashName] == nil {
+		return nil, ErrAuthenticationFailed
+	}
+	return b.scram[hashName], nil
+}
+
+func (b *challengeTestBackend) CramMD5Secret(username string) (string, error) {
+	if username != "tim" {
+		return "", ErrAuthenticationFailed
+	}
+	return "tanstaaftanstaaf", nil
+}
+
+func TestScramSHA1(t *testing.T) {
+	// Test vector from RFC 5802 section 5
+	salt, _ := base64.StdEncoding.DecodeString("QSXCR+Q6sek8bf92")
+	creds, err := NewScramCredentials("SHA-1", "pencil", salt, 4096)
+	if err != nil {
+		t.Fatalf("NewScramCredentials returned error: %+v", err)
+	}
+	c, _ := (&Server{Backend: &challengeTestBackend{scram: map[string]*ScramCredentials{"SHA-1": creds}}}).newSession(nil)
+	s := scramMechanism("SHA-1", false).New(c).(*scramServer)
+	s.nonce = "3rfcNHYJY1ZVvWVs7j"
+
+	challenge, done, err := s.Next([]byte("n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL"))
+	exp := "r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,s=QSXCR+Q6sek8bf92,i=4096"
+	if err != nil || done || string(challenge) != exp {
+		t.Fatalf("Next returned %q %v %+v expected %q", challenge, done, err, exp)
+	}
+
+	challenge, done, err = s.Next([]byte("c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=v0X8v3Bz2T0CJGbJQyF0X+HI4Ts="))
+	exp = "v=rmF9pqV8S7suAoZWja4dJRkFsKQ="
+	if err != nil || !done || string(challenge) != exp {
+		t.Fatalf("Next returned %q %v %+v expected %q", challenge, done, err, exp)
+	}
+	if username, _ := s.User(); username != "user" {
+		t.Fatalf("User returned %s expected user", username)
+	}
+
+	s = scramMechanism("SHA-1", false).New(c).(*scramServer)
+	s.nonce = "3rfcNHYJY1ZVvWVs7j"
+	s.Next([]byte("n,,n=user,r=fyko+d2lbbFgONRv9qkxdawL"))
+	if _, _, err := s.Next([]byte("c=biws,r=fyko+d2lbbFgONRv9qkxdawL3rfcNHYJY1ZVvWVs7j,p=AAX8v3Bz2T0CJGbJQyF0X+HI4Ts=")); err != ErrAuthenticationFailed {
+		t.Fatalf("Next returned %+v for an invalid proof", err)
+	}
+}
+
+func TestScramSHA256(t *testing.T) {
+	// Test vector from RFC 7677 section 3
+	salt, _ := base64.StdEncoding.DecodeString("W22ZaJ0SNY7soEsUEjb6gQ==")
+	creds, err := NewScramCredentials("SHA-256", "pencil", salt, 4096)
+	if err != nil {
+		t.Fatalf("NewScramCredentials returned error: %+v", err)
+	}
+	c, _ := (&Server{Backend: &challengeTestBackend{scram: map[string]*ScramCredentials{"SHA-256": creds}}}).newSession(nil)
+	s := scramMechanism("SHA-256", false).New(c).(*scramServer)
+	s.nonce = "%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0"
+
+	challenge, done, err := s.Next([]byte("n,,n=user,r=rOprNGfwEbeRWgbNEkqO"))
+	exp := "r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,s=W22ZaJ0SNY7soEsUEjb6gQ==,i=4096"
+	if err != nil || done || string(challenge) != exp {
+		t.Fatalf("Next returned %q %v %+v expected %q", challenge, done, err, exp)
+	}
+
+	challenge, done, err = s.Next([]byte("c=biws,r=rOprNGfwEbeRWgbNEkqO%hvYDpWUa2RaTCAfuxFIlj)hNlF$k0,p=dHzbZapWIk4jUhN+Ute9ytag9zjfMHgsqmmiz7AndVQ="))
+	exp = "v=6rriTRBi23WpRR/wtup+mMhUZUn/dB5nLTJRsjl95G4="
+	if err != nil || !done || string(challenge) != exp {
+		t.Fatalf("Next returned %q %v %+v expected %q", challenge, done, err, exp)
+	}
+
+	// Without TLS the client can't use channel binding, so "y" isn't a downgrade
+	s = scramMechanism("SHA-256", false).New(c).(*scramServer)
+	if _, _, err := s.Next([]byte("y,,n=user,r=rOprNGfwEbeRWgbNEkqO")); err != nil {
+		t.Fatalf("Next returned %+v for y without TLS", err)
+	}
+	if scramMechanism("SHA-256", true).Available(c) {
+		t.Fatal("SCRAM-SHA-256-PLUS is available without TLS")
+	}
+}
+
+// newTestCertificate returns a self-signed certificate that can also be
+// used as its own CA.
+func newTestCertificate(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("GenerateKey failed: %+v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		DNSNames:              []string{name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{usage},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("CreateCertificate failed: %+v", err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatalf("ParseCertificate failed: %+v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: cert}
+}
+
+// tlsPipe returns both ends of a TLS connection after the handshake.
+func tlsPipe(t *testing.T, serverConfig, clientConfig *tls.Config) (server, client *tls.Conn) {
+	sc, cc := net.Pipe()
+	server = tls.Server(sc, serverConfig)
+	client = tls.Client(cc, clientConfig)
+	errc := make(chan error, 1)
+	go func() {
+		errc <- server.Handshake()
+	}()
+	if err := client.Handshake(); err != nil {
+		t.Fatalf("client handshake failed: %+v", err)
+	}
+	if err := <-errc; err != nil {
+		t.Fatalf("server handshake failed: %+v", err)
+	}
+	return server, client
+}
+
+// scramClientFinal returns the client-final-message for the server-first
+// message and the channel binding data.
+func scramClientFinal(hashName, password, clientFirstBare, serverFirst string, cb []byte) string {
+	h := scramHashes[hashName]
+	attrs := strings.Split(serverFirst, ",")
+	salt, _ := base64.StdEncoding.DecodeString(attrs[1][2:])
+	iterations, _ := strconv.Atoi(attrs[2][2:])
+	withoutProof := "c=" + base64.StdEncoding.EncodeToString(cb) + "," + attrs[0]
+	salted := scramHi(h, []byte(password), salt, iterations)
+	clientKey := scramHMAC(h, salted, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	signature := scramHMAC(h, storedKey.Sum(nil), []byte(clientFirstBare+","+serverFirst+","+withoutProof))
+	for i := range clientKey {
+		clientKey[i] ^= signature[i]
+	}
+	return withoutProof + ",p=" + base64.StdEncoding.EncodeToString(clientKey)
+}
+
+func TestScramChannelBinding(t *testing.T) {
+	creds, err := NewScramCredentials("SHA-256", "pencil", []byte("salt"), 4096)
+	if err != nil {
+		t.Fatalf("NewScramCredentials returned error: %+v", err)
+	}
+	backend := &challengeTestBackend{scram: map[string]*ScramCredentials{"SHA-256": creds}}
+	cert := newTestCertificate(t, "localhost", x509.ExtKeyUsageServerAuth)
+	single := &tls.Config{Certificates: []tls.Certificate{cert}, SessionTicketsDisabled: true}
+	callback := &tls.Config{
+		GetCertificate: func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+			return &cert, nil
+		},
+		SessionTicketsDisabled: true,
+	}
+
+	tests := []struct {
+		config     *tls.Config
+		maxVersion uint16
+		cbType     string
+		ok         bool
+	}{
+		{single, tls.VersionTLS13, "tls-exporter", true},
+		{single, tls.VersionTLS13, "tls-unique", false},
+		{single, tls.VersionTLS13, "tls-server-end-point", true},
+		{single, tls.VersionTLS12, "tls-exporter", true},
+		{single, tls.VersionTLS12, "tls-unique", true},
+		{callback, tls.VersionTLS13, "tls-exporter", true},
+		{callback, tls.VersionTLS13, "tls-server-end-point", false},
+		{single, tls.VersionTLS13, "tls-bogus", false},
+	}
+	for _, test := range tests {
+		server, client := tlsPipe(t, test.config, &tls.Config{InsecureSkipVerify: true, MaxVersion: test.maxVersion})
+		c, _ := (&Server{Backend: backend, TlsConfig: test.config}).newSession(server)
+		if !scramMechanism("SHA-256", true).Available(c) {
+			t.Fatalf("SCRAM-SHA-256-PLUS is not available for %s", test.cbType)
+		}
+
+		// A client that supports channel binding must not fall back to
+		// the plain mechanism when the server offers -PLUS.
+		s := scramMechanism("SHA-256", false).New(c)
+		if _, _, err := s.Next([]byte("y,,n=user,r=abc")); err != ErrAuthenticationFailed {
+			t.Fatalf("Next returned %+v for a downgrade", err)
+		}
+
+		s = scramMechanism("SHA-256", true).New(c)
+		gs2Header := "p=" + test.cbType + ",,"
+		serverFirst, _, err := s.Next([]byte(gs2Header + "n=user,r=abc"))
+		if !test.ok {
+			if err != ErrAuthenticationFailed {
+				t.Fatalf("Next returned %+v for unavailable channel binding %s", err, test.cbType)
+			}
+			server.NetConn().Close()
+			client.NetConn().Close()
+			continue
+		}
+		if err != nil {
+			t.Fatalf("Next returned %+v for channel binding %s", err, test.cbType)
+		}
+		state := client.ConnectionState()
+		var data []byte
+		switch test.cbType {
+		case "tls-exporter":
+			data, _ = state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		case "tls-unique":
+			data = state.TLSUnique
+		case "tls-server-end-point":
+			sum := sha256.Sum256(state.PeerCertificates[0].Raw)
+			data = sum[:]
+		}
+		final := scramClientFinal("SHA-256", "pencil", "n=user,r=abc", string(serverFirst), append([]byte(gs2Header), data...))
+		if _, done, err := s.Next([]byte(final)); err != nil || !done {
+			t.Fatalf("Next returned %v %+v for channel binding %s", done, err, test.cbType)
+		}
+
+		// Channel binding data of another connection must be rejected
+		s = scramMechanism("SHA-256", true).New(c)
+		serverFirst, _, _ = s.Next([]byte(gs2Header + "n=user,r=abc"))
+		final = scramClientFinal("SHA-256", "pencil", "n=user,r=abc", string(serverFirst), append([]byte(gs2Header), make([]byte, len(data))...))
+		if _, _, err := s.Next([]byte(final)); err != ErrAuthenticationFailed {
+			t.Fatalf("Next returned %+v for invalid channel binding %s", err, test.cbType)
+		}
+		server.NetConn().Close()
+		client.NetConn().Close()
+	}
+}
+
+func TestCramMD5(t *testing.T) {
+	// Example from RFC 2195
+	c, _ := (&Server{Backend: &challengeTestBackend{}}).newSession(nil)
+	s := newCramMD5Server(c).(*cramMD5Server)
+	s.challenge = "<1896.697170952@postoffice.reston.mci.net>"
+	if challenge, _, _ := s.Next(nil); string(challenge) != s.challenge {
+		t.Fatalf("Next returned challenge %q expected %q", challenge, s.challenge)
+	}
+	if _, done, err := s.Next([]byte("tim b913a602c7eda7a495b4e6e7334d3890")); err != nil || !done {
+		t.Fatalf("Next returned %v %+v", done, err)
+	}
+	s = newCramMD5Server(c).(*cramMD5Server)
+	s.challenge = "<1896.697170952@postoffice.reston.mci.net>"
+	if _, _, err := s.Next([]byte("tim a913a602c7eda7a495b4e6e7334d3890")); err != ErrAuthenticationFailed {
+		t.Fatalf("Next returned %+v for an invalid digest", err)
+	}
+}
+
+func TestOAuthBearer(t *testing.T) {
+	srv := &Server{
+		Backend:       &challengeTestBackend{},
+		InsecureLogin: true,
+		ValidateToken: func(username, token string) (string, error) {
+			if token != "vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==" {
+				return "", ErrAuthenticationFailed
+			}
+			return "user@example.com", nil
+		},
+	}
+	c, _ := srv.newSession(nil)
+
+	s := newOAuthBearerServer(c)
+	if _, done, err := s.Next([]byte("n,a=user@example.com,\x01host=server.example.com\x01port=143\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01")); err != nil || !done {
+		t.Fatalf("Next returned %v %+v", done, err)
+	}
+	if username, _ := s.User(); username != "user@example.com" {
+		t.Fatalf("User returned %s expected user@example.com", username)
+	}
+
+	s = newOAuthBearerServer(c)
+	challenge, done, err := s.Next([]byte("n,,\x01auth=Bearer invalid\x01\x01"))
+	exp := `{"status":"invalid_token","schemes":"bearer"}`
+	if err != nil || done || string(challenge) != exp {
+		t.Fatalf("Next returned %q %v %+v expected %q", challenge, done, err, exp)
+	}
+	if _, _, err := s.Next([]byte("\x01")); err != ErrAuthenticationFailed {
+		t.Fatalf("Next returned %+v after an error challenge", err)
+	}
+
+	s = newXOAuth2Server(c)
+	if _, done, err := s.Next([]byte("user=someuser@example.com\x01auth=Bearer vF9dft4qmTc2Nvb3RlckBhbHRhdmlzdGEuY29tCg==\x01\x01")); err != nil || !done {
+		t.Fatalf("Next returned %v %+v", done, err)
+	}
+	s = newXOAuth2Server(c)
+	challenge, done, err = s.Next([]byte("user=someuser@example.com\x01auth=Bearer invalid\x01\x01"))
+	exp = `{"status":"401","schemes":"Bearer"}`
+	if err != nil || done || string(challenge) != exp {
+		t.Fatalf("Next returned %q %v %+v expected %q", challenge, done, err, exp)
+	}
+}
@@ -0,0 +1,321 @@
+package imapd
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"time"
+)
+
+var (
+	scramHashes = map[string]func() hash.Hash{
+		"SHA-1":   sha1.New,
+		"SHA-256": sha256.New,
+	}
+)
+
+// ScramCredentials are the salted credentials stored for a user to
+// authenticate with a SCRAM mechanism (RFC 5802).
+type ScramCredentials struct {
+	Salt       []byte
+	Iterations int
+	StoredKey  []byte
+	ServerKey  []byte
+}
+
+// NewScramCredentials derives the credentials to store for a password
+// using the named hash ("SHA-1" or "SHA-256").
+func NewScramCredentials(hashName, password string, salt []byte, iterations int) (*ScramCredentials, error) {
+	h := scramHashes[hashName]
+	if h == nil {
+		return nil, fmt.Errorf("imapd: unsupported SCRAM hash %s", hashName)
+	}
+	salted := scramHi(h, []byte(password), salt, iterations)
+	clientKey := scramHMAC(h, salted, []byte("Client Key"))
+	storedKey := h()
+	storedKey.Write(clientKey)
+	return &ScramCredentials{
+		Salt:       salt,
+		Iterations: iterations,
+		StoredKey:  storedKey.Sum(nil),
+		ServerKey:  scramHMAC(h, salted, []byte("Server Key")),
+	}, nil
+}
+
+func scramHMAC(h func() hash.Hash, key, data []byte) []byte {
+	m := hmac.New(h, key)
+	m.Write(data)
+	return m.Sum(nil)
+}
+
+// scramHi is PBKDF2 with a single output block.
+func scramHi(h func() hash.Hash, password, salt []byte, iterations int) []byte {
+	u := scramHMAC(h, password, append(append([]byte{}, salt...), 0, 0, 0, 1))
+	out := append([]byte{}, u...)
+	for i := 1; i < iterations; i++ {
+		u = scramHMAC(h, password, u)
+		for j := range out {
+			out[j] ^= u[j]
+		}
+	}
+	return out
+}
+
+// newNonce returns a random printable nonce.
+func newNonce() string {
+	b := make([]byte, 18)
+	if _, err := rand.Read(b); err != nil {
+		binary.BigEndian.PutUint64(b, uint64(time.Now().UnixNano()))
+	}
+	return base64.RawStdEncoding.EncodeToString(b)
+}
+
+func scramMechanism(hashName string, plus bool) *SASLMechanism {
+	return &SASLMechanism{
+		Available: func(c Connection) bool {
+			if _, ok := c.Server().Backend.(ScramAuthenticator); !ok {
+				return false
+			}
+			// -PLUS is only offered if a channel binding can be computed.
+			return !plus || channelBindingAvailable(c)
+		},
+		New: func(c Connection) SASLServer {
+			return &scramServer{c: c, hashName: hashName, h: scramHashes[hashName], plus: plus, nonce: newNonce()}
+		},
+	}
+}
+
+// scramServer implements the SCRAM-SHA-* and SCRAM-SHA-*-PLUS mechanisms
+// (RFC 5802, RFC 7677).
+type scramServer struct {
+	c        Connection
+	hashName string
+	h        func() hash.Hash
+	plus     bool
+	nonce    string
+
+	step        int
+	gs2Header   string
+	cbType      string
+	clientFirst string // client-first-message-bare
+	serverFirst string
+	fullNonce   string
+	creds       *ScramCredentials
+	username    string
+	backend     Backend
+}
+
+func (s *scramServer) Next(response []byte) ([]byte, bool, error) {
+	if response == nil {
+		return []byte{}, false, nil
+	}
+	s.step++
+	switch s.step {
+	case 1:
+		return s.clientFirstMessage(string(response))
+	case 2:
+		return s.clientFinalMessage(string(response))
+	}
+	return nil, false, ErrAuthenticationFailed
+}
+
+func (s *scramServer) User() (string, Backend) {
+	return s.username, s.backend
+}
+
+// clientFirstMessage handles: gs2-header client-first-message-bare
+func (s *scramServer) clientFirstMessage(msg string) ([]byte, bool, error) {
+	parts := strings.SplitN(msg, ",", 3)
+	if len(parts) != 3 {
+		return nil, false, ErrAuthenticationFailed
+	}
+	switch {
+	case parts[0] == "n", parts[0] == "y":
+		// A client that supports channel binding and chose not to
+		// use it while we offered it may be the victim of a downgrade.
+		if s.plus || (parts[0] == "y" && s.cbOffered()) {
+			return nil, false, ErrAuthenticationFailed
+		}
+	case strings.HasPrefix(parts[0], "p="):
+		if !s.plus || channelBinding(s.c, parts[0][2:]) == nil {
+			return nil, false, ErrAuthenticationFailed
+		}
+		s.cbType = parts[0][2:]
+	default:
+		return nil, false, ErrAuthenticationFailed
+	}
+	authzid := ""
+	if parts[1] != "" {
+		if !strings.HasPrefix(parts[1], "a=") {
+			return nil, false, ErrAuthenticationFailed
+		}
+		authzid = scramUnescape(parts[1][2:])
+	}
+	s.gs2Header = parts[0] + "," + parts[1] + ","
+	s.clientFirst = parts[2]
+
+	attrs := strings.Split(s.clientFirst, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "n=") || !strings.HasPrefix(attrs[1], "r=") {
+		return nil, false, ErrAuthenticationFailed
+	}
+	s.username = scramUnescape(attrs[0][2:])
+	if authzid != "" && authzid != s.username {
+		return nil, false, ErrAuthenticationFailed
+	}
+	cnonce := attrs[1][2:]
+	if cnonce == "" {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	creds, err := s.c.Server().Backend.(ScramAuthenticator).ScramCredentials(s.username, s.hashName)
+	if err != nil {
+		return nil, false, err
+	}
+	s.creds = creds
+	s.fullNonce = cnonce + s.nonce
+	s.serverFirst = fmt.Sprintf("r=%s,s=%s,i=%d", s.fullNonce, base64.StdEncoding.EncodeToString(creds.Salt), creds.Iterations)
+	return []byte(s.serverFirst), false, nil
+}
+
+// clientFinalMessage handles: c=channel-binding,r=nonce,...,p=proof
+func (s *scramServer) clientFinalMessage(msg string) ([]byte, bool, error) {
+	i := strings.LastIndex(msg, ",p=")
+	if i < 0 {
+		return nil, false, ErrAuthenticationFailed
+	}
+	withoutProof := msg[:i]
+	proof, err := base64.StdEncoding.DecodeString(msg[i+3:])
+	if err != nil {
+		return nil, false, ErrAuthenticationFailed
+	}
+	attrs := strings.Split(withoutProof, ",")
+	if len(attrs) < 2 || !strings.HasPrefix(attrs[0], "c=") || attrs[1] != "r="+s.fullNonce {
+		return nil, false, ErrAuthenticationFailed
+	}
+	cb, err := base64.StdEncoding.DecodeString(attrs[0][2:])
+	if err != nil {
+		return nil, false, ErrAuthenticationFailed
+	}
+	expected := []byte(s.gs2Header)
+	if s.plus {
+		data := channelBinding(s.c, s.cbType)
+		if data == nil {
+			return nil, false, ErrAuthenticationFailed
+		}
+		expected = append(expected, data...)
+	}
+	if !hmac.Equal(cb, expected) {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	authMessage := []byte(s.clientFirst + "," + s.serverFirst + "," + withoutProof)
+	clientSignature := scramHMAC(s.h, s.creds.StoredKey, authMessage)
+	if len(proof) != len(clientSignature) {
+		return nil, false, ErrAuthenticationFailed
+	}
+	clientKey := make([]byte, len(proof))
+	for i := range proof {
+		clientKey[i] = proof[i] ^ clientSignature[i]
+	}
+	storedKey := s.h()
+	storedKey.Write(clientKey)
+	if !hmac.Equal(storedKey.Sum(nil), s.creds.StoredKey) {
+		return nil, false, ErrAuthenticationFailed
+	}
+
+	b, err := s.c.Server().Backend.(ScramAuthenticator).LookupUser(s.username)
+	if err != nil {
+		return nil, false, err
+	}
+	s.backend = b
+	serverSignature := scramHMAC(s.h, s.creds.ServerKey, authMessage)
+	return []byte("v=" + base64.StdEncoding.EncodeToString(serverSignature)), true, nil
+}
+
+// cbOffered reports whether the -PLUS variant of the mechanism is offered.
+func (s *scramServer) cbOffered() bool {
+	return channelBindingAvailable(s.c)
+}
+
+// channelBindingTypes are the supported channel binding types.
+var channelBindingTypes = []string{"tls-exporter", "tls-unique", "tls-server-end-point"}
+
+// channelBindingAvailable reports whether any channel binding can be
+// computed for the connection.
+func channelBindingAvailable(c Connection) bool {
+	for _, cbType := range channelBindingTypes {
+		if channelBinding(c, cbType) != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// channelBinding returns the channel binding data of the type for the
+// connection (RFC 5929, RFC 9266), or nil if it can't be computed.
+func channelBinding(c Connection, cbType string) []byte {
+	state, ok := c.TLSConnectionState()
+	if !ok {
+		return nil
+	}
+	switch cbType {
+	case "tls-exporter":
+		// Only defined for TLS 1.3 and TLS 1.2 with the extended master
+		// secret, otherwise ExportKeyingMaterial fails.
+		data, err := state.ExportKeyingMaterial("EXPORTER-Channel-Binding", nil, 32)
+		if err != nil {
+			return nil
+		}
+		return data
+	case "tls-unique":
+		// TLSUnique is nil on TLS 1.3 and on resumed connections.
+		return state.TLSUnique
+	case "tls-server-end-point":
+		data, err := tlsServerEndPoint(c.Server().TlsConfig)
+		if err != nil {
+			return nil
+		}
+		return data
+	}
+	return nil
+}
+
+// tlsServerEndPoint returns the hash of the server certificate. The
+// certificate is only known when the config has a single one that isn't
+// chosen by a callback.
+func tlsServerEndPoint(config *tls.Config) ([]byte, error) {
+	if config == nil || config.GetCertificate != nil || config.GetConfigForClient != nil ||
+		len(config.Certificates) != 1 || len(config.Certificates[0].Certificate) == 0 {
+		return nil, errors.New("imapd: unable to determine server certificate for channel binding")
+	}
+	cert, err := x509.ParseCertificate(config.Certificates[0].Certificate[0])
+	if err != nil {
+		return nil, err
+	}
+	var h hash.Hash
+	switch cert.SignatureAlgorithm {
+	case x509.SHA384WithRSA, x509.ECDSAWithSHA384, x509.SHA384WithRSAPSS:
+		h = sha512.New384()
+	case x509.SHA512WithRSA, x509.ECDSAWithSHA512, x509.SHA512WithRSAPSS:
+		h = sha512.New()
+	default:
+		// MD5 and SHA-1 are replaced by SHA-256
+		h = sha256.New()
+	}
+	h.Write(cert.Raw)
+	return h.Sum(nil), nil
+}
+
+func scramUnescape(name string) string {
+	return strings.NewReplacer("=2C", ",", "=3D", "=").Replace(name)
+}
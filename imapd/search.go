@@ -0,0 +1,343 @@
+package imapd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"mime"
+	"net/mail"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const searchDateFormat = "2-Jan-2006"
+
+var errBadCharset = errors.New("imapd: unsupported charset")
+
+var searchFlags = map[string]string{
+	"ANSWERED": FlagAnswered,
+	"DELETED":  FlagDeleted,
+	"DRAFT":    FlagDraft,
+	"FLAGGED":  FlagFlagged,
+	"RECENT":   FlagReceent,
+	"SEEN":     FlagSeen,
+}
+
+// SearchCriteria are the parsed arguments of a SEARCH command. A message
+// matches when it matches all of the keys.
+type SearchCriteria struct {
+	Charset string // upper case, empty if not given
+	Keys    []SearchKey
+}
+
+// SearchKey is a single search key of RFC 3501 section 6.4.4. Name is the
+// upper case key name such as "FROM" or "UNSEEN". A parenthesized list of
+// keys has the Name "AND" and a sequence set has the Name "SEQ". The server
+// converts sequence sets to "UID" keys before handing criteria to a Mailbox.
+type SearchKey struct {
+	Name  string
+	Field string      // HEADER field name
+	Value string      // string, KEYWORD and UNKEYWORD argument
+	Date  time.Time   // BEFORE, ON, SINCE, SENTBEFORE, SENTON and SENTSINCE
+	Size  uint32      // LARGER and SMALLER
+	Set   []Range     // SEQ and UID
+	Keys  []SearchKey // operands of AND, NOT and OR
+}
+
+// SearchMessage is a message to be matched against SearchCriteria.
+type SearchMessage struct {
+	UID          uint32
+	Flags        []string
+	InternalDate time.Time
+	Size         uint32
+	Message      []byte // the full RFC 5322 message
+}
+
+// parseSearchCriteria parses the arguments of SEARCH.
+func parseSearchCriteria(args []arg) (*SearchCriteria, error) {
+	c := &SearchCriteria{}
+	if len(args) >= 2 && args[0].kind == argAtom && strings.EqualFold(args[0].str, "CHARSET") {
+		charset, ok := args[1].astring()
+		if !ok {
+			return nil, syntaxError("invalid charset")
+		}
+		c.Charset = strings.ToUpper(charset)
+		if c.Charset != "US-ASCII" && c.Charset != "UTF-8" {
+			return nil, errBadCharset
+		}
+		args = args[2:]
+	}
+	if len(args) == 0 {
+		return nil, syntaxError("missing search keys")
+	}
+	for len(args) > 0 {
+		var k SearchKey
+		var err error
+		if k, args, err = parseSearchKey(args); err != nil {
+			return nil, err
+		}
+		c.Keys = append(c.Keys, k)
+	}
+	return c, nil
+}
+
+// parseSearchKey parses the first search key and returns the remaining
+// arguments.
+func parseSearchKey(args []arg) (SearchKey, []arg, error) {
+	a := args[0]
+	args = args[1:]
+	if a.kind == argList {
+		k := SearchKey{Name: "AND"}
+		list := a.list
+		if len(list) == 0 {
+			return k, nil, syntaxError("empty search key list")
+		}
+		for len(list) > 0 {
+			var sub SearchKey
+			var err error
+			if sub, list, err = parseSearchKey(list); err != nil {
+				return k, nil, err
+			}
+			k.Keys = append(k.Keys, sub)
+		}
+		return k, args, nil
+	}
+	if a.kind != argAtom || a.str == "" {
+		return SearchKey{}, nil, syntaxError("invalid search key")
+	}
+	if c := a.str[0]; c >= '0' && c <= '9' || c == '*' {
+		set := parseRangeSet(a.str)
+		if set == nil {
+			return SearchKey{}, nil, syntaxError("invalid sequence set")
+		}
+		return SearchKey{Name: "SEQ", Set: set}, args, nil
+	}
+	k := SearchKey{Name: strings.ToUpper(a.str)}
+	var ok bool
+	switch k.Name {
+	case "ALL", "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "NEW", "OLD", "RECENT", "SEEN",
+		"UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		return k, args, nil
+	case "BCC", "BODY", "CC", "FROM", "SUBJECT", "TEXT", "TO":
+		if len(args) > 0 {
+			k.Value, ok = args[0].astring()
+		}
+	case "KEYWORD", "UNKEYWORD":
+		if len(args) > 0 && args[0].kind == argAtom {
+			k.Value, ok = args[0].str, true
+		}
+	case "HEADER":
+		if len(args) > 1 {
+			if k.Field, ok = args[0].astring(); ok {
+				k.Value, ok = args[1].astring()
+			}
+			args = args[1:]
+		}
+	case "BEFORE", "ON", "SINCE", "SENTBEFORE", "SENTON", "SENTSINCE":
+		if len(args) > 0 && (args[0].kind == argAtom || args[0].kind == argQuoted) {
+			var err error
+			k.Date, err = time.Parse(searchDateFormat, args[0].str)
+			ok = err == nil
+		}
+	case "LARGER", "SMALLER":
+		if len(args) > 0 && args[0].kind == argAtom {
+			n, err := strconv.ParseUint(args[0].str, 10, 32)
+			k.Size, ok = uint32(n), err == nil
+		}
+	case "UID":
+		if len(args) > 0 && args[0].kind == argAtom {
+			k.Set = parseRangeSet(args[0].str)
+			ok = k.Set != nil
+		}
+	case "NOT":
+		if len(args) > 0 {
+			var sub SearchKey
+			var err error
+			if sub, args, err = parseSearchKey(args); err != nil {
+				return k, nil, err
+			}
+			k.Keys = []SearchKey{sub}
+			return k, args, nil
+		}
+	case "OR":
+		for i := 0; i < 2 && len(args) > 0; i++ {
+			var sub SearchKey
+			var err error
+			if sub, args, err = parseSearchKey(args); err != nil {
+				return k, nil, err
+			}
+			k.Keys = append(k.Keys, sub)
+		}
+		if len(k.Keys) == 2 {
+			return k, args, nil
+		}
+	default:
+		return k, nil, syntaxError("unknown search key " + a.str)
+	}
+	if !ok {
+		return k, nil, syntaxError("invalid argument to " + k.Name)
+	}
+	return k, args[1:], nil
+}
+
+// Match reports whether the message matches the criteria. It can be used by
+// a Mailbox that implements Searcher without native support for some keys.
+func (c *SearchCriteria) Match(m *SearchMessage) bool {
+	e := &searchEval{m: m}
+	for i := range c.Keys {
+		if !e.match(&c.Keys[i]) {
+			return false
+		}
+	}
+	return true
+}
+
+// searchEval matches keys against a message whose header is parsed when
+// first needed.
+type searchEval struct {
+	m      *SearchMessage
+	parsed bool
+	header textproto.MIMEHeader
+	body   []byte
+}
+
+func (e *searchEval) match(k *SearchKey) bool {
+	switch k.Name {
+	case "ALL":
+		return true
+	case "AND":
+		for i := range k.Keys {
+			if !e.match(&k.Keys[i]) {
+				return false
+			}
+		}
+		return true
+	case "NOT":
+		return !e.match(&k.Keys[0])
+	case "OR":
+		return e.match(&k.Keys[0]) || e.match(&k.Keys[1])
+	case "ANSWERED", "DELETED", "DRAFT", "FLAGGED", "RECENT", "SEEN":
+		return e.hasFlag(searchFlags[k.Name])
+	case "UNANSWERED", "UNDELETED", "UNDRAFT", "UNFLAGGED", "UNSEEN":
+		return !e.hasFlag(searchFlags[k.Name[2:]])
+	case "NEW":
+		return e.hasFlag(FlagReceent) && !e.hasFlag(FlagSeen)
+	case "OLD":
+		return !e.hasFlag(FlagReceent)
+	case "KEYWORD":
+		return e.hasFlag(k.Value)
+	case "UNKEYWORD":
+		return !e.hasFlag(k.Value)
+	case "BEFORE":
+		return searchDate(e.m.InternalDate).Before(k.Date)
+	case "ON":
+		return searchDate(e.m.InternalDate).Equal(k.Date)
+	case "SINCE":
+		return !searchDate(e.m.InternalDate).Before(k.Date)
+	case "SENTBEFORE", "SENTON", "SENTSINCE":
+		e.parse()
+		sent, err := mail.ParseDate(e.header.Get("Date"))
+		if err != nil {
+			return false
+		}
+		d := searchDate(sent)
+		switch k.Name {
+		case "SENTBEFORE":
+			return d.Before(k.Date)
+		case "SENTON":
+			return d.Equal(k.Date)
+		}
+		return !d.Before(k.Date)
+	case "LARGER":
+		return e.m.Size > k.Size
+	case "SMALLER":
+		return e.m.Size < k.Size
+	case "UID":
+		return rangesContain(k.Set, e.m.UID)
+	case "BCC", "CC", "FROM", "SUBJECT", "TO":
+		return e.headerContains(k.Name, k.Value)
+	case "HEADER":
+		return e.headerContains(k.Field, k.Value)
+	case "BODY":
+		e.parse()
+		return containsFold(string(e.body), k.Value)
+	case "TEXT":
+		return containsFold(string(e.m.Message), k.Value)
+	}
+	return false
+}
+
+func (e *searchEval) hasFlag(flag string) bool {
+	for _, f := range e.m.Flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerContains reports whether any field with the name contains value
+// once encoded words are decoded. An empty value matches any such field.
+func (e *searchEval) headerContains(name, value string) bool {
+	e.parse()
+	dec := &mime.WordDecoder{}
+	for _, v := range e.header[textproto.CanonicalMIMEHeaderKey(name)] {
+		if d, err := dec.DecodeHeader(v); err == nil {
+			v = d
+		}
+		if containsFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+func (e *searchEval) parse() {
+	if e.parsed {
+		return
+	}
+	e.parsed = true
+	r := textproto.NewReader(bufio.NewReader(bytes.NewReader(e.m.Message)))
+	e.header, _ = r.ReadMIMEHeader()
+	if i := bytes.Index(e.m.Message, []byte("\r\n\r\n")); i >= 0 {
+		e.body = e.m.Message[i+4:]
+	} else if i := bytes.Index(e.m.Message, []byte("\n\n")); i >= 0 {
+		e.body = e.m.Message[i+2:]
+	}
+}
+
+// searchDate returns the date of t disregarding time and timezone.
+func searchDate(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, time.UTC)
+}
+
+func containsFold(s, substr string) bool {
+	return strings.Contains(strings.ToLower(s), strings.ToLower(substr))
+}
+
+// needs reports which message data the keys need to be evaluated.
+func (c *SearchCriteria) needs() (flags, date, size, message bool) {
+	var walk func(keys []SearchKey)
+	walk = func(keys []SearchKey) {
+		for _, k := range keys {
+			switch k.Name {
+			case "AND", "NOT", "OR":
+				walk(k.Keys)
+			case "BEFORE", "ON", "SINCE":
+				date = true
+			case "LARGER", "SMALLER":
+				size = true
+			case "ALL", "SEQ", "UID":
+			case "BCC", "BODY", "CC", "FROM", "HEADER", "SENTBEFORE", "SENTON", "SENTSINCE", "SUBJECT", "TEXT", "TO":
+				message = true
+			default:
+				flags = true
+			}
+		}
+	}
+	walk(c.Keys)
+	return
+}
@@ -0,0 +1,106 @@
+package imapd
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseSearchCriteria(t *testing.T) {
+	args := []arg{
+		{kind: argAtom, str: "CHARSET"}, {kind: argAtom, str: "utf-8"},
+		{kind: argAtom, str: "1:3,*"},
+		{kind: argAtom, str: "or"}, {kind: argAtom, str: "SEEN"},
+		{kind: argList, list: []arg{{kind: argAtom, str: "NOT"}, {kind: argAtom, str: "FROM"}, {kind: argQuoted, str: "joe"}}},
+		{kind: argAtom, str: "HEADER"}, {kind: argAtom, str: "X-Mailer"}, {kind: argQuoted, str: ""},
+		{kind: argAtom, str: "SINCE"}, {kind: argAtom, str: "1-Feb-1994"},
+		{kind: argAtom, str: "LARGER"}, {kind: argAtom, str: "100"},
+	}
+	c, err := parseSearchCriteria(args)
+	if err != nil {
+		t.Fatalf("parseSearchCriteria returned error: %+v", err)
+	}
+	exp := &SearchCriteria{
+		Charset: "UTF-8",
+		Keys: []SearchKey{
+			{Name: "SEQ", Set: []Range{{1, 3, false}, {0, 0, true}}},
+			{Name: "OR", Keys: []SearchKey{
+				{Name: "SEEN"},
+				{Name: "AND", Keys: []SearchKey{{Name: "NOT", Keys: []SearchKey{{Name: "FROM", Value: "joe"}}}}},
+			}},
+			{Name: "HEADER", Field: "X-Mailer"},
+			{Name: "SINCE", Date: time.Date(1994, 2, 1, 0, 0, 0, 0, time.UTC)},
+			{Name: "LARGER", Size: 100},
+		},
+	}
+	if !reflect.DeepEqual(c, exp) {
+		t.Fatalf("parseSearchCriteria returned %+v expected %+v", c, exp)
+	}
+
+	for _, args := range [][]arg{
+		{},
+		{{kind: argAtom, str: "FROM"}},
+		{{kind: argAtom, str: "OR"}, {kind: argAtom, str: "SEEN"}},
+		{{kind: argAtom, str: "SINCE"}, {kind: argAtom, str: "yesterday"}},
+		{{kind: argAtom, str: "UNKNOWN"}},
+	} {
+		if _, err := parseSearchCriteria(args); err == nil {
+			t.Fatalf("parseSearchCriteria accepted %+v", args)
+		}
+	}
+	if _, err := parseSearchCriteria([]arg{{kind: argAtom, str: "CHARSET"}, {kind: argAtom, str: "KOI8-R"}, {kind: argAtom, str: "ALL"}}); err != errBadCharset {
+		t.Fatalf("parseSearchCriteria returned %+v for an unknown charset", err)
+	}
+}
+
+func TestSearchMatch(t *testing.T) {
+	m := &SearchMessage{
+		UID:          7,
+		Flags:        []string{FlagSeen, "$Work"},
+		InternalDate: time.Date(2012, 6, 12, 23, 30, 0, 0, time.FixedZone("", -4*60*60)),
+		Size:         120,
+		Message: []byte("Date: Tue, 12 Jun 2012 08:09:48 -0400\r\n" +
+			"From: Joe <joe@example.com>\r\n" +
+			"Subject: =?UTF-8?Q?Caf=C3=A9?= menu\r\n" +
+			"\r\n" +
+			"Lunch is served\r\n"),
+	}
+	date := func(s string) time.Time {
+		d, _ := time.Parse(searchDateFormat, s)
+		return d
+	}
+	tests := []struct {
+		key   SearchKey
+		match bool
+	}{
+		{SearchKey{Name: "SEEN"}, true},
+		{SearchKey{Name: "UNSEEN"}, false},
+		{SearchKey{Name: "KEYWORD", Value: "$work"}, true},
+		{SearchKey{Name: "NEW"}, false},
+		{SearchKey{Name: "OLD"}, true},
+		{SearchKey{Name: "ON", Date: date("12-Jun-2012")}, true},
+		{SearchKey{Name: "BEFORE", Date: date("12-Jun-2012")}, false},
+		{SearchKey{Name: "SINCE", Date: date("12-Jun-2012")}, true},
+		{SearchKey{Name: "SENTON", Date: date("12-Jun-2012")}, true},
+		{SearchKey{Name: "SENTBEFORE", Date: date("1-Jan-2012")}, false},
+		{SearchKey{Name: "LARGER", Size: 120}, false},
+		{SearchKey{Name: "SMALLER", Size: 121}, true},
+		{SearchKey{Name: "UID", Set: []Range{{5, 8, false}}}, true},
+		{SearchKey{Name: "FROM", Value: "JOE@"}, true},
+		{SearchKey{Name: "SUBJECT", Value: "café"}, true},
+		{SearchKey{Name: "HEADER", Field: "date"}, true},
+		{SearchKey{Name: "HEADER", Field: "X-Mailer"}, false},
+		{SearchKey{Name: "BODY", Value: "lunch"}, true},
+		{SearchKey{Name: "BODY", Value: "menu"}, false},
+		{SearchKey{Name: "TEXT", Value: "menu"}, true},
+		{SearchKey{Name: "NOT", Keys: []SearchKey{{Name: "SEEN"}}}, false},
+		{SearchKey{Name: "OR", Keys: []SearchKey{{Name: "UNSEEN"}, {Name: "TO", Value: "x"}}}, false},
+		{SearchKey{Name: "AND", Keys: []SearchKey{{Name: "SEEN"}, {Name: "ALL"}}}, true},
+	}
+	for _, test := range tests {
+		c := &SearchCriteria{Keys: []SearchKey{test.key}}
+		if match := c.Match(m); match != test.match {
+			t.Fatalf("Match returned %v for %+v expected %v", match, test.key, test.match)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package imapd
+
+import (
+	"bytes"
+	"strconv"
+	"strings"
+)
+
+// parseSection splits a section specification such as 1.2.HEADER.FIELDS
+// into its part numbers and the text specifier.
+func parseSection(section string) (parts []int, text string, ok bool) {
+	for section != "" {
+		i := strings.IndexByte(section, '.')
+		if i < 0 {
+			i = len(section)
+		}
+		n, err := strconv.Atoi(section[:i])
+		if err != nil {
+			break
+		}
+		if n < 1 {
+			return nil, "", false
+		}
+		parts = append(parts, n)
+		section = strings.TrimPrefix(section[i:], ".")
+	}
+	switch text = strings.ToUpper(section); text {
+	case "", "HEADER", "HEADER.FIELDS", "HEADER.FIELDS.NOT", "TEXT":
+		return parts, text, true
+	case "MIME":
+		return parts, text, len(parts) > 0
+	}
+	return nil, "", false
+}
+
+// BodySection returns the data of a BODY[section]<partial>, RFC822,
+// RFC822.HEADER or RFC822.TEXT item of a raw RFC 5322 message. It returns
+// nil if the section doesn't exist in the message.
+func BodySection(message []byte, item MessageDataItemName) []byte {
+	section := item.Section
+	switch item.Name {
+	case "RFC822":
+		section = ""
+	case "RFC822.HEADER":
+		section = "HEADER"
+	case "RFC822.TEXT":
+		section = "TEXT"
+	}
+	parts, text, ok := parseSection(section)
+	if !ok {
+		return nil
+	}
+	if len(parts) == 0 && text == "" {
+		return partial(message, item.Partial)
+	}
+	p := parseMIMEPart(message, false, 0)
+	for i, n := range parts {
+		if p = p.child(n, i == 0); p == nil {
+			return nil
+		}
+	}
+	var data []byte
+	switch text {
+	case "":
+		data = p.body
+	case "MIME":
+		data = p.rawHeader
+	default:
+		// HEADER and TEXT of a part refer to the encapsulated message.
+		if len(parts) > 0 {
+			if p = p.message; p == nil {
+				return nil
+			}
+		}
+		switch text {
+		case "HEADER":
+			data = p.rawHeader
+		case "HEADER.FIELDS":
+			data = filterHeader(p.rawHeader, item.FieldNames, false)
+		case "HEADER.FIELDS.NOT":
+			data = filterHeader(p.rawHeader, item.FieldNames, true)
+		case "TEXT":
+			data = p.body
+		}
+	}
+	return partial(data, item.Partial)
+}
+
+// child returns body part n of a multipart or message/rfc822 part, or of
+// the message itself if isMessage is true. Part 1 of a message that isn't
+// multipart is its body.
+func (p *mimePart) child(n int, isMessage bool) *mimePart {
+	if p.message != nil {
+		p, isMessage = p.message, true
+	}
+	if p.parts != nil {
+		if n > len(p.parts) {
+			return nil
+		}
+		return p.parts[n-1]
+	}
+	if n != 1 || !isMessage {
+		return nil
+	}
+	return p
+}
+
+// filterHeader returns the header fields named in names, or all other
+// fields if not is true, followed by an empty line.
+func filterHeader(header []byte, names []string, not bool) []byte {
+	out := []byte{}
+	keep := false
+	for i := 0; i < len(header); {
+		end := len(header)
+		if n := bytes.IndexByte(header[i:], '\n'); n >= 0 {
+			end = i + n + 1
+		}
+		line := header[i:end]
+		i = end
+		if len(bytes.TrimRight(line, "\r\n")) == 0 {
+			break
+		}
+		// Continuation lines belong to the previous field.
+		if line[0] != ' ' && line[0] != '\t' {
+			name := line
+			if n := bytes.IndexByte(line, ':'); n >= 0 {
+				name = line[:n]
+			}
+			keep = containsFieldName(names, string(bytes.TrimSpace(name))) != not
+		}
+		if keep {
+			out = append(out, line...)
+		}
+	}
+	return append(out, "\r\n"...)
+}
+
+func containsFieldName(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
+
+// partial returns the <start.count> substring of data if requested.
+func partial(data []byte, p []int) []byte {
+	if data == nil {
+		data = []byte{}
+	}
+	if len(p) != 2 {
+		return data
+	}
+	start, count := p[0], p[1]
+	if start < 0 || start > len(data) {
+		start = len(data)
+	}
+	if count < 0 || count > len(data)-start {
+		count = len(data) - start
+	}
+	return data[start : start+count]
+}
@@ -0,0 +1,44 @@
+package imapd
+
+import (
+	"testing"
+)
+
+func TestBodySection(t *testing.T) {
+	msg := []byte(testMIMEMessage)
+	tests := []struct {
+		item MessageDataItemName
+		exp  string
+	}{
+		{MessageDataItemName{Name: "BODY[]", Partial: []int{0, 10}}, "From: joe@"},
+		{MessageDataItemName{Name: "RFC822.HEADER"}, "From: joe@example.com\r\nSubject: Report\r\nMIME-Version: 1.0\r\nContent-Type: multipart/mixed; boundary=\"outer\"\r\n\r\n"},
+		{MessageDataItemName{Name: "BODY[]", Section: "HEADER.FIELDS", FieldNames: []string{"SUBJECT", "From"}}, "From: joe@example.com\r\nSubject: Report\r\n\r\n"},
+		{MessageDataItemName{Name: "BODY[]", Section: "HEADER.FIELDS.NOT", FieldNames: []string{"FROM", "CONTENT-TYPE", "MIME-VERSION"}}, "Subject: Report\r\n\r\n"},
+		{MessageDataItemName{Name: "BODY[]", Section: "1.1"}, "Plain text"},
+		{MessageDataItemName{Name: "BODY[]", Section: "1.2.MIME"}, "Content-Type: text/html; charset=UTF-8\r\nContent-Transfer-Encoding: quoted-printable\r\nContent-Language: en, de\r\n\r\n"},
+		{MessageDataItemName{Name: "BODY[]", Section: "1.2", Partial: []int{3, 4}}, "Html"},
+		{MessageDataItemName{Name: "BODY[]", Section: "2"}, "JVBERi0xLjQK"},
+		{MessageDataItemName{Name: "BODY[]", Section: "3.HEADER"}, "From: ann@example.com\r\nSubject: Forwarded\r\n\r\n"},
+		{MessageDataItemName{Name: "BODY[]", Section: "3.TEXT"}, "Hello"},
+		{MessageDataItemName{Name: "BODY[]", Section: "3.1"}, "Hello"},
+		{MessageDataItemName{Name: "BODY[]", Section: "2", Partial: []int{100, 4}}, ""},
+		{MessageDataItemName{Name: "BODY[]", Section: "2", Partial: []int{4, 4294967295}}, "Ri0xLjQK"},
+		{MessageDataItemName{Name: "BODY[]", Section: "2", Partial: []int{1 << 62, 1 << 62}}, ""},
+	}
+	for _, test := range tests {
+		if data := BodySection(msg, test.item); string(data) != test.exp {
+			t.Fatalf("BodySection(%s) returned %q expected %q", test.item, data, test.exp)
+		}
+	}
+
+	for _, section := range []string{"4", "1.3", "2.HEADER", "1.1.1"} {
+		if data := BodySection(msg, MessageDataItemName{Name: "BODY[]", Section: section}); data != nil {
+			t.Fatalf("BodySection(%s) returned %q for a missing part", section, data)
+		}
+	}
+
+	plain := []byte("Subject: Plain\r\n\r\nText\r\n")
+	if data := BodySection(plain, MessageDataItemName{Name: "BODY[]", Section: "1"}); string(data) != "Text\r\n" {
+		t.Fatalf("BodySection(1) returned %q for a message that isn't multipart", data)
+	}
+}
@@ -5,10 +5,11 @@ import (
 	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 var (
-	reDataItemName = regexp.MustCompile(`(?i)((body(?:\.peek)?)\[([a-z0-9\.]*)(\s\([a-z\-\s]*\))?\](<\d+.\d+>)?|[a-z0-9\.]+)(\s|$)`)
+	reDataItemName = regexp.MustCompile(`(?i)^((body(?:\.peek)?)\[([a-z0-9\.]*)(\s\([a-z0-9\-\s]*\))?\](<\d+\.\d+>)?|[a-z0-9\.]+)$`)
 
 	validDataItemNames = map[string]bool{
 		"BODY":          true,
@@ -38,6 +39,10 @@ func (e ErrInvalidDataItem) Error() string {
 	return fmt.Sprintf("imapd: '%s' is not a valid data item selector", string(e))
 }
 
+// Range is a range of message sequence numbers or UIDs. End is 0 for a
+// single number. Infinite is set when the range ends with * and a Start of
+// 0 with Infinite set is * by itself. Ranges given to a Mailbox have * replaced
+// by the largest number in use.
 type Range struct {
 	Start    uint32
 	End      uint32
@@ -60,14 +65,40 @@ func (d MessageDataItemName) String() string {
 			out = append(out, " (", strings.Join(d.FieldNames, " "), ")")
 		}
 		out = append(out, "]")
-		if d.Partial != nil && len(d.Partial) == 2 {
-			out = append(out, "<", strconv.Itoa(d.Partial[0]), ".", strconv.Itoa(d.Partial[1]), ">")
-		}
+	}
+	if len(d.Partial) == 2 {
+		out = append(out, "<", strconv.Itoa(d.Partial[0]), ".", strconv.Itoa(d.Partial[1]), ">")
 	}
 	return strings.Join(out, "")
 }
 
+// responseName returns the name of the item in a FETCH response. It's
+// BODY rather than BODY.PEEK and only includes the origin octet of a
+// partial fetch.
+func (d MessageDataItemName) responseName() string {
+	if d.Name == "BODY.PEEK[]" {
+		d.Name = "BODY[]"
+	}
+	name := d.String()
+	if len(d.Partial) == 2 {
+		name = name[:strings.LastIndexByte(name, '.')] + ">"
+	}
+	return name
+}
+
+func hasFlag(flags []string, flag string) bool {
+	for _, f := range flags {
+		if strings.EqualFold(f, flag) {
+			return true
+		}
+	}
+	return false
+}
+
 func (r Range) String() string {
+	if r.Start == 0 && r.Infinite {
+		return "*"
+	}
 	if r.End == 0 {
 		if r.Infinite {
 			return fmt.Sprintf("%d:*", r.Start)
@@ -77,87 +108,258 @@ func (r Range) String() string {
 	return fmt.Sprintf("%d:%d", r.Start, r.End)
 }
 
+// Contains reports whether n is within the range. A range may be given in
+// either order, so 5:2 is the same as 2:5.
+func (r Range) Contains(n uint32) bool {
+	if r.Infinite {
+		return n >= r.Start
+	}
+	if r.End == 0 {
+		return n == r.Start
+	}
+	if r.Start > r.End {
+		return n >= r.End && n <= r.Start
+	}
+	return n >= r.Start && n <= r.End
+}
+
+// resolve returns the range with * replaced by max, the largest number in use.
+func (r Range) resolve(max uint32) Range {
+	if r.Infinite {
+		if r.Start == 0 {
+			r.Start = max
+		}
+		r.End = max
+		r.Infinite = false
+	}
+	return r
+}
+
+func rangesContain(set []Range, n uint32) bool {
+	for _, r := range set {
+		if r.Contains(n) {
+			return true
+		}
+	}
+	return false
+}
+
 // Parse strings of the type: 1,2:5,3:*
 func parseRangeSet(rs string) []Range {
 	set := make([]Range, 0)
 	for _, s := range strings.Split(rs, ",") {
-		if len(s) == 0 {
-			return nil
-		}
 		p := strings.Split(s, ":")
 		if len(p) > 2 {
 			return nil
 		}
-		start, err := strconv.ParseUint(p[0], 10, 32)
-		if err != nil {
+		start, ok := parseSeqNumber(p[0])
+		if !ok {
 			return nil
 		}
-		end := uint64(0)
-		infinite := false
+		r := Range{Start: start, Infinite: start == 0}
 		if len(p) > 1 {
-			if p[1] == "*" {
-				infinite = true
+			end, ok := parseSeqNumber(p[1])
+			if !ok {
+				return nil
+			}
+			// *:n is the same as n:*
+			if start == 0 {
+				r.Start = end
+			} else if end == 0 {
+				r.Infinite = true
 			} else {
-				end, err = strconv.ParseUint(p[1], 10, 32)
-				if err != nil {
-					return nil
-				}
+				r.End = end
 			}
 		}
-		set = append(set, Range{uint32(start), uint32(end), infinite})
+		set = append(set, r)
 	}
 	return set
 }
 
-// Parse and validate a data item list: (UID BODY[HEADER.FIELDS (DATE FROM)]<0.1024>)
-func parseMessageDataItemNames(names string) ([]MessageDataItemName, error) {
-	if names[0] != '(' {
-		items := macroMessageDataItemNames[names]
-		if items != nil {
+// parseSeqNumber parses a non-zero number or * which is returned as 0.
+func parseSeqNumber(s string) (uint32, bool) {
+	if s == "*" {
+		return 0, true
+	}
+	n, err := strconv.ParseUint(s, 10, 32)
+	return uint32(n), err == nil && n != 0
+}
+
+// Parse and validate the data items of FETCH, which are a macro, a single
+// item or a list of items: (UID BODY[HEADER.FIELDS (DATE FROM)]<0.1024>)
+func parseMessageDataItemNames(a arg) ([]MessageDataItemName, error) {
+	names := a.list
+	switch a.kind {
+	case argAtom:
+		if items := macroMessageDataItemNames[strings.ToUpper(a.str)]; items != nil {
 			return items, nil
 		}
-	} else {
-		names = names[1 : len(names)-1]
+		names = []arg{a}
+	case argList:
+	default:
+		return nil, ErrInvalidDataItem(a.String())
+	}
+	if len(names) == 0 {
+		return nil, ErrInvalidDataItem(a.String())
 	}
+	items := make([]MessageDataItemName, 0, len(names))
+	for _, n := range names {
+		if n.kind != argAtom {
+			return nil, ErrInvalidDataItem(n.String())
+		}
+		item, err := parseMessageDataItemName(n.str)
+		if err != nil {
+			return nil, err
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
 
-	items := make([]MessageDataItemName, 0)
-	for _, s := range reDataItemName.FindAllStringSubmatch(names, -1) {
-		item := MessageDataItemName{}
-		if s[2] != "" {
-			// parse BODY(.PEEK)[... (...)]<X.Y>
-			var fieldNames []string = nil
-			if s[4] != "" {
-				fieldNames = strings.Split(s[4][2:len(s[4])-1], " ")
+// Parse and validate a single data item: BODY.PEEK[HEADER.FIELDS (DATE FROM)]<0.1024>
+func parseMessageDataItemName(name string) (MessageDataItemName, error) {
+	s := reDataItemName.FindStringSubmatch(name)
+	if s == nil {
+		return MessageDataItemName{}, ErrInvalidDataItem(name)
+	}
+	item := MessageDataItemName{Name: strings.ToUpper(name)}
+	if s[2] != "" {
+		// parse BODY(.PEEK)[... (...)]<X.Y>
+		var fieldNames []string = nil
+		if s[4] != "" {
+			fieldNames = strings.Split(s[4][2:len(s[4])-1], " ")
+		}
+		var partial []int = nil
+		if s[5] != "" {
+			p := strings.Split(s[5][1:len(s[5])-1], ".")
+			// Offsets are number and nz-number which are 32-bit.
+			start, err := strconv.ParseUint(p[0], 10, 32)
+			if err != nil {
+				return MessageDataItemName{}, ErrInvalidDataItem(name)
 			}
-			var partial []int = nil
-			if s[5] != "" {
-				p := strings.Split(s[5][1:len(s[5])-1], ".")
-				start, err := strconv.Atoi(p[0])
-				if err != nil {
-					return nil, err
-				}
-				count, err := strconv.Atoi(p[1])
-				if err != nil {
-					return nil, err
-				}
-				partial = []int{start, count}
+			count, err := strconv.ParseUint(p[1], 10, 32)
+			if err != nil || count == 0 {
+				return MessageDataItemName{}, ErrInvalidDataItem(name)
 			}
-			item = MessageDataItemName{
-				Name:       strings.ToUpper(s[2]) + "[]",
-				Section:    strings.ToUpper(s[3]),
-				FieldNames: fieldNames,
-				Partial:    partial,
+			partial = []int{int(start), int(count)}
+		}
+		item = MessageDataItemName{
+			Name:       strings.ToUpper(s[2]) + "[]",
+			Section:    strings.ToUpper(s[3]),
+			FieldNames: fieldNames,
+			Partial:    partial,
+		}
+		if _, text, ok := parseSection(item.Section); !ok || (fieldNames != nil) != strings.HasPrefix(text, "HEADER.FIELDS") {
+			return MessageDataItemName{}, ErrInvalidDataItem(name)
+		}
+	}
+	if valid := validDataItemNames[item.Name]; !valid {
+		return MessageDataItemName{}, ErrInvalidDataItem(name)
+	}
+	return item, nil
+}
+
+// Match a mailbox name against a LIST pattern where * matches zero or more
+// characters and % matches zero or more characters excluding the
+// hierarchy delimiter. The INBOX component is matched case-insensitively.
+func matchMailbox(pattern, name, delim string) bool {
+	if len(name) >= 5 && strings.EqualFold(name[:5], "INBOX") && (len(name) == 5 || strings.HasPrefix(name[5:], delim)) {
+		if len(pattern) >= 5 && strings.EqualFold(pattern[:5], "INBOX") {
+			pattern = "INBOX" + pattern[5:]
+		}
+		name = "INBOX" + name[5:]
+	}
+	return matchWildcards(pattern, name, delim)
+}
+
+// matchWildcards matches in time proportional to the product of the
+// lengths of the pattern and name rather than backtracking.
+func matchWildcards(pattern, name, delim string) bool {
+	// Runs of wildcards match the same as a single one, which is * if the
+	// run contains any *.
+	var p []byte
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		if n := len(p); n > 0 && (c == '*' || c == '%') && (p[n-1] == '*' || p[n-1] == '%') {
+			if c == '*' {
+				p[n-1] = '*'
 			}
-		} else {
-			item = MessageDataItemName{
-				Name: strings.ToUpper(strings.TrimSpace(s[0])),
+			continue
+		}
+		p = append(p, c)
+	}
+	// next[j] reports whether the rest of the pattern after position i
+	// matches name[j:].
+	next := make([]bool, len(name)+1)
+	cur := make([]bool, len(name)+1)
+	next[len(name)] = true
+	for i := len(p) - 1; i >= 0; i-- {
+		for j := len(name); j >= 0; j-- {
+			switch p[i] {
+			case '*':
+				cur[j] = next[j] || j < len(name) && cur[j+1]
+			case '%':
+				cur[j] = next[j] || j < len(name) && (delim == "" || !strings.HasPrefix(name[j:], delim)) && cur[j+1]
+			default:
+				cur[j] = j < len(name) && p[i] == name[j] && next[j+1]
 			}
 		}
-		if valid := validDataItemNames[item.Name]; !valid {
-			return items, ErrInvalidDataItem(s[0])
+		next, cur = cur, next
+	}
+	return next[0]
+}
+
+// Parse a date-time such as " 8-Aug-2004 13:51:21 -0500" where the day may
+// be padded with a space or zero.
+func parseInternalDate(s string) (time.Time, error) {
+	return time.Parse("2-Jan-2006 15:04:05 -0700", strings.TrimLeft(s, " "))
+}
+
+// isAtom reports whether s is a valid atom which can be sent back to
+// clients as is. The parser accepts more within brackets.
+func isAtom(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if c := s[i]; c <= ' ' || c >= 0x7f || strings.IndexByte(`(){%*"\]`, c) >= 0 {
+			return false
 		}
-		items = append(items, item)
 	}
+	return true
+}
 
-	return items, nil
+// Parse and validate a flag list such as (\Seen \Answered $Forwarded).
+// The \Recent flag can not be set by clients.
+func parseFlags(a arg) ([]string, bool) {
+	if a.kind != argList {
+		return nil, false
+	}
+	flags := make([]string, 0, len(a.list))
+	for _, it := range a.list {
+		if it.kind != argAtom {
+			return nil, false
+		}
+		flag := it.str
+		if flag[0] == '\\' {
+			switch strings.ToLower(flag) {
+			case `\seen`:
+				flag = FlagSeen
+			case `\answered`:
+				flag = FlagAnswered
+			case `\flagged`:
+				flag = FlagFlagged
+			case `\deleted`:
+				flag = FlagDeleted
+			case `\draft`:
+				flag = FlagDraft
+			default:
+				return nil, false
+			}
+		} else if !isAtom(flag) {
+			return nil, false
+		}
+		flags = append(flags, flag)
+	}
+	return flags, true
 }
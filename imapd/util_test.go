@@ -2,7 +2,9 @@ package imapd
 
 import (
 	// "fmt"
+	"bufio"
 	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -22,14 +24,68 @@ func TestParseRangeSet(t *testing.T) {
 		t.Fatalf("parseRangeSet returned %+v expected %+v", rs, exp)
 	}
 
-	exp = nil
-	if rs := parseRangeSet("abc"); !reflect.DeepEqual(rs, exp) {
+	exp = []Range{{0, 0, true}, {4, 0, true}}
+	if rs := parseRangeSet("*,*:4"); !reflect.DeepEqual(rs, exp) {
 		t.Fatalf("parseRangeSet returned %+v expected %+v", rs, exp)
 	}
+
+	for _, rs := range []string{"abc", "0:4", "1,", "1:2:3"} {
+		if set := parseRangeSet(rs); set != nil {
+			t.Fatalf("parseRangeSet returned %+v for %s", set, rs)
+		}
+	}
+}
+
+func TestRangeResolve(t *testing.T) {
+	tests := []struct {
+		r   Range
+		max uint32
+		exp Range
+	}{
+		{Range{0, 0, true}, 7, Range{7, 7, false}},
+		{Range{3, 0, true}, 7, Range{3, 7, false}},
+		{Range{9, 0, true}, 7, Range{9, 7, false}},
+		{Range{2, 5, false}, 7, Range{2, 5, false}},
+	}
+	for _, test := range tests {
+		if r := test.r.resolve(test.max); r != test.exp {
+			t.Fatalf("%s.resolve(%d) returned %+v expected %+v", test.r, test.max, r, test.exp)
+		}
+	}
+}
+
+func TestRangeContains(t *testing.T) {
+	tests := []struct {
+		r        Range
+		n        uint32
+		contains bool
+	}{
+		{Range{3, 0, false}, 3, true},
+		{Range{3, 0, false}, 4, false},
+		{Range{2, 5, false}, 5, true},
+		{Range{5, 2, false}, 2, true},
+		{Range{5, 2, false}, 6, false},
+		{Range{5, 0, true}, 4, false},
+		{Range{5, 0, true}, 1000, true},
+	}
+	for _, test := range tests {
+		if c := test.r.Contains(test.n); c != test.contains {
+			t.Fatalf("%s.Contains(%d) returned %v expected %v", test.r, test.n, c, test.contains)
+		}
+	}
+}
+
+// testArg returns the first argument parsed from s.
+func testArg(t *testing.T, s string) arg {
+	args, err := (&parser{br: bufio.NewReader(strings.NewReader(s + "\r\n"))}).readArgs(false)
+	if err != nil || len(args) == 0 {
+		t.Fatalf("readArgs(%q) returned %+v %+v", s, args, err)
+	}
+	return args[0]
 }
 
 func TestParseDataItemName(t *testing.T) {
-	if items, err := parseMessageDataItemNames("UID"); err != nil {
+	if items, err := parseMessageDataItemNames(testArg(t, "UID")); err != nil {
 		t.Fatalf("parseMessageDataItemNames returned error: %+v", err)
 	} else if items == nil {
 		t.Fatalf("parseMessageDataItemNames returned nil items")
@@ -40,7 +96,7 @@ func TestParseDataItemName(t *testing.T) {
 		}
 	}
 
-	if items, err := parseMessageDataItemNames("(BODY[] RFC822.TEXT)"); err != nil {
+	if items, err := parseMessageDataItemNames(testArg(t, "(BODY[] RFC822.TEXT)")); err != nil {
 		t.Fatalf("parseMessageDataItemNames returned error: %+v", err)
 	} else if items == nil {
 		t.Fatalf("parseMessageDataItemNames returned nil items")
@@ -51,7 +107,7 @@ func TestParseDataItemName(t *testing.T) {
 		}
 	}
 
-	if items, err := parseMessageDataItemNames("(BODY.PEEK[HEADER.FIELDS (DATE FROM)]<5.20>)"); err != nil {
+	if items, err := parseMessageDataItemNames(testArg(t, "(BODY.PEEK[HEADER.FIELDS (DATE FROM)]<5.20>)")); err != nil {
 		t.Fatalf("parseMessageDataItemNames returned error: %+v", err)
 	} else if items == nil {
 		t.Fatalf("parseMessageDataItemNames returned nil items")
@@ -62,7 +118,59 @@ func TestParseDataItemName(t *testing.T) {
 		}
 	}
 
-	if _, err := parseMessageDataItemNames("(UID INVALID)"); err == nil {
-		t.Fatalf("parseMessageDataItemNames returned nil error on invalid input")
+	if items, err := parseMessageDataItemNames(testArg(t, "fast")); err != nil || !reflect.DeepEqual(items, macroMessageDataItemNames["FAST"]) {
+		t.Fatalf("parseMessageDataItemNames returned %+v %+v for a lowercase macro", items, err)
+	}
+
+	for _, names := range []string{"(UID INVALID)", "BODY[FOO]", "BODY[MIME]", "BODY[HEADER.FIELDS]",
+		"BODY.PEEK[]<9223372036854775807.9223372036854775807>", "BODY[]<0.0>", "BODY[]<1x2>",
+		"()", "(FLAGS junk!! UID)", `(FLAGS "UID")`, `"FLAGS"`, "(FLAGS (UID))", "NIL"} {
+		if _, err := parseMessageDataItemNames(testArg(t, names)); err == nil {
+			t.Fatalf("parseMessageDataItemNames returned nil error on invalid input %s", names)
+		}
+	}
+}
+
+func TestMatchMailbox(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		match         bool
+	}{
+		{"*", "INBOX", true},
+		{"*", "Archive/2012/Jun", true},
+		{"%", "Archive", true},
+		{"%", "Archive/2012", false},
+		{"Archive/%", "Archive/2012", true},
+		{"Archive/%", "Archive/2012/Jun", false},
+		{"Archive/*", "Archive/2012/Jun", true},
+		{"Archive/%/Jun", "Archive/2012/Jun", true},
+		{"inbox", "INBOX", true},
+		{"inbox/%", "INBOX/Drafts", true},
+		{"sent", "Sent", false},
+		{"S%", "Sent Items", true},
+		{"", "INBOX", false},
+		{"a%*b", "a/x/b", true},
+		{"a*%b", "a/x/b", true},
+		{"a%%b", "a/x/b", false},
+		{"*a*a*a*a*a*a*a*ab", strings.Repeat("a", 60), false},
+		{"*a*a*a*a*a*a*a*ab", strings.Repeat("a", 60) + "b", true},
+	}
+	for _, test := range tests {
+		if m := matchMailbox(test.pattern, test.name, "/"); m != test.match {
+			t.Fatalf("matchMailbox(%q, %q) returned %v expected %v", test.pattern, test.name, m, test.match)
+		}
+	}
+}
+
+func TestParseFlags(t *testing.T) {
+	a := arg{kind: argList, list: []arg{{kind: argAtom, str: `\SEEN`}, {kind: argAtom, str: "$Work"}}}
+	if flags, ok := parseFlags(a); !ok || !reflect.DeepEqual(flags, []string{FlagSeen, "$Work"}) {
+		t.Fatalf("parseFlags returned %q %v", flags, ok)
+	}
+	for _, flag := range []string{`\Recent`, `\Other`, "a[b c)]", "a]", "a*", "a%", "a{", `a"`, "a\\b", "caf\xc3\xa9"} {
+		a := arg{kind: argList, list: []arg{{kind: argAtom, str: flag}}}
+		if flags, ok := parseFlags(a); ok {
+			t.Fatalf("parseFlags returned %q for %q", flags, flag)
+		}
 	}
 }